@@ -0,0 +1,328 @@
+package mongodb
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Cache 缓存接口，值为 bson 编码后的文档
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, val []byte, ttl time.Duration)
+	Delete(key string)
+}
+
+// CacheStats 缓存命中统计
+type CacheStats struct {
+	Hits    uint64 // 命中次数
+	Misses  uint64 // 未命中次数
+	Loads   uint64 // 实际查询 mongo 的次数，并发未命中会被合并
+	Shared  uint64 // 合并到其他查询的次数
+	Errors  uint64 // 查询出错次数
+	Invalid uint64 // 失效次数
+}
+
+// CacheContext 带读缓存的 DialContext。
+// 通过 FindID 读取的文档会被缓存，通过 UpdateID/UpsertID/RemoveID 写入时自动失效。
+type CacheContext struct {
+	*DialContext
+	store docStore
+	cache Cache
+	ttl   time.Duration
+	group flightGroup
+	stats CacheStats
+
+	genMu sync.Mutex
+	gens  map[string]*cacheGen
+}
+
+// docStore CacheContext 读写文档使用的接口，默认为 DialContext
+type docStore interface {
+	FindID(db string, collection string, id interface{}, result interface{}) error
+	UpdateID(db string, collection string, id interface{}, update interface{}) error
+	UpsertID(db string, collection string, id interface{}, update interface{}) error
+	RemoveID(db string, collection string, id interface{}) error
+}
+
+// cacheGen 正在加载的文档的失效代数，加载期间失效时不写入缓存
+type cacheGen struct {
+	gen     uint64
+	loading int
+}
+
+// WithCache 在 DialContext 前加一层读缓存，cache 为 nil 时使用默认的 LRU。
+func (c *DialContext) WithCache(cache Cache, ttl time.Duration) *CacheContext {
+	if cache == nil {
+		cache = NewLRUCache(10000, ttl)
+	}
+	return newCacheContext(c, c, cache, ttl)
+}
+
+// WithTenants 启用多租户路由，租户的读写同样经过缓存
+func (c *CacheContext) WithTenants(resolve TenantResolver) *Tenants {
+	return NewTenants(c, resolve)
+}
+
+func newCacheContext(c *DialContext, store docStore, cache Cache, ttl time.Duration) *CacheContext {
+	return &CacheContext{
+		DialContext: c,
+		store:       store,
+		cache:       cache,
+		ttl:         ttl,
+		gens:        map[string]*cacheGen{},
+	}
+}
+
+// cacheKey 包含 id 的类型，_id 为 1 和 "1" 的文档不能共用缓存
+func cacheKey(db string, collection string, id interface{}) string {
+	return fmt.Sprintf("%s.%s/%T:%v", db, collection, id, id)
+}
+
+// goroutine safe
+func (c *CacheContext) FindID(db string, collection string, id interface{}, result interface{}) error {
+	key := cacheKey(db, collection, id)
+	if data, ok := c.cache.Get(key); ok {
+		atomic.AddUint64(&c.stats.Hits, 1)
+		return bson.Unmarshal(data, result)
+	}
+	atomic.AddUint64(&c.stats.Misses, 1)
+
+	data, err, shared := c.group.Do(key, func() ([]byte, error) {
+		atomic.AddUint64(&c.stats.Loads, 1)
+		gen := c.beginLoad(key)
+		var raw bson.Raw
+		err := c.store.FindID(db, collection, id, &raw)
+		c.endLoad(key, gen, raw.Data, err == nil)
+		if err != nil {
+			return nil, err
+		}
+		return raw.Data, nil
+	})
+	if shared {
+		atomic.AddUint64(&c.stats.Shared, 1)
+	}
+	if err != nil {
+		atomic.AddUint64(&c.stats.Errors, 1)
+		return err
+	}
+	return bson.Unmarshal(data, result)
+}
+
+// goroutine safe
+func (c *CacheContext) UpdateID(db string, collection string, id interface{}, update interface{}) error {
+	defer c.Invalidate(db, collection, id)
+	return c.store.UpdateID(db, collection, id, update)
+}
+
+// goroutine safe
+func (c *CacheContext) UpsertID(db string, collection string, id interface{}, update interface{}) error {
+	defer c.Invalidate(db, collection, id)
+	return c.store.UpsertID(db, collection, id, update)
+}
+
+// goroutine safe
+func (c *CacheContext) RemoveID(db string, collection string, id interface{}) error {
+	defer c.Invalidate(db, collection, id)
+	return c.store.RemoveID(db, collection, id)
+}
+
+// Invalidate 使某个文档的缓存失效，用于绕过 CacheContext 直接写库的场景。
+// 失效前开始的加载不再被之后的 FindID 共享，保证读到自己的写入
+func (c *CacheContext) Invalidate(db string, collection string, id interface{}) {
+	atomic.AddUint64(&c.stats.Invalid, 1)
+	key := cacheKey(db, collection, id)
+	c.genMu.Lock()
+	if g, ok := c.gens[key]; ok {
+		g.gen++
+	}
+	c.cache.Delete(key)
+	c.group.Forget(key)
+	c.genMu.Unlock()
+}
+
+// beginLoad 开始加载文档，返回当前的失效代数
+func (c *CacheContext) beginLoad(key string) uint64 {
+	c.genMu.Lock()
+	defer c.genMu.Unlock()
+	g, ok := c.gens[key]
+	if !ok {
+		g = &cacheGen{}
+		c.gens[key] = g
+	}
+	g.loading++
+	return g.gen
+}
+
+// endLoad 加载完成，加载期间没有失效时才写入缓存，避免旧数据覆盖失效
+func (c *CacheContext) endLoad(key string, gen uint64, data []byte, ok bool) {
+	c.genMu.Lock()
+	defer c.genMu.Unlock()
+	g := c.gens[key]
+	if ok && g.gen == gen {
+		c.cache.Set(key, data, c.ttl)
+	}
+	g.loading--
+	if g.loading == 0 {
+		delete(c.gens, key)
+	}
+}
+
+// Stats 获取缓存统计
+func (c *CacheContext) Stats() CacheStats {
+	return CacheStats{
+		Hits:    atomic.LoadUint64(&c.stats.Hits),
+		Misses:  atomic.LoadUint64(&c.stats.Misses),
+		Loads:   atomic.LoadUint64(&c.stats.Loads),
+		Shared:  atomic.LoadUint64(&c.stats.Shared),
+		Errors:  atomic.LoadUint64(&c.stats.Errors),
+		Invalid: atomic.LoadUint64(&c.stats.Invalid),
+	}
+}
+
+// =================== LRU ======================
+
+type lruEntry struct {
+	key    string
+	val    []byte
+	expire time.Time
+}
+
+// LRUCache 进程内 LRU 缓存，带过期时间
+type LRUCache struct {
+	sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+// NewLRUCache 创建 LRU 缓存，size 为最大条目数，ttl 为默认过期时间，0 表示不过期。
+func NewLRUCache(size int, ttl time.Duration) *LRUCache {
+	if size <= 0 {
+		size = 10000
+	}
+	return &LRUCache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Get 获取缓存
+func (l *LRUCache) Get(key string) ([]byte, bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	e, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	ent := e.Value.(*lruEntry)
+	if !ent.expire.IsZero() && time.Now().After(ent.expire) {
+		l.removeElement(e)
+		return nil, false
+	}
+	l.ll.MoveToFront(e)
+	return ent.val, true
+}
+
+// Set 写入缓存，ttl 为 0 时使用默认过期时间
+func (l *LRUCache) Set(key string, val []byte, ttl time.Duration) {
+	if ttl == 0 {
+		ttl = l.ttl
+	}
+	var expire time.Time
+	if ttl > 0 {
+		expire = time.Now().Add(ttl)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if e, ok := l.items[key]; ok {
+		ent := e.Value.(*lruEntry)
+		ent.val = val
+		ent.expire = expire
+		l.ll.MoveToFront(e)
+		return
+	}
+	l.items[key] = l.ll.PushFront(&lruEntry{key, val, expire})
+	for l.ll.Len() > l.size {
+		l.removeElement(l.ll.Back())
+	}
+}
+
+// Delete 删除缓存
+func (l *LRUCache) Delete(key string) {
+	l.Lock()
+	defer l.Unlock()
+
+	if e, ok := l.items[key]; ok {
+		l.removeElement(e)
+	}
+}
+
+// Len 当前条目数
+func (l *LRUCache) Len() int {
+	l.Lock()
+	defer l.Unlock()
+	return l.ll.Len()
+}
+
+func (l *LRUCache) removeElement(e *list.Element) {
+	l.ll.Remove(e)
+	delete(l.items, e.Value.(*lruEntry).key)
+}
+
+// =================== singleflight ======================
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	val []byte
+	err error
+}
+
+// flightGroup 合并同一个 key 的并发查询
+type flightGroup struct {
+	sync.Mutex
+	calls map[string]*flightCall
+}
+
+func (g *flightGroup) Do(key string, fn func() ([]byte, error)) ([]byte, error, bool) {
+	g.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.Unlock()
+		call.wg.Wait()
+		return call.val, call.err, true
+	}
+	call := new(flightCall)
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.Unlock()
+
+	call.val, call.err = fn()
+	call.wg.Done()
+
+	g.Lock()
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+	g.Unlock()
+	return call.val, call.err, false
+}
+
+// Forget 之后的 Do 不再共享正在进行的调用，已经在等待的调用方仍然得到它的结果
+func (g *flightGroup) Forget(key string) {
+	g.Lock()
+	delete(g.calls, key)
+	g.Unlock()
+}
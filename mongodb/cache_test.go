@@ -0,0 +1,186 @@
+package mongodb
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestLRUCache(t *testing.T) {
+	l := NewLRUCache(2, 0)
+	l.Set("a", []byte("1"), 0)
+	l.Set("b", []byte("2"), 0)
+	l.Get("a")
+	l.Set("c", []byte("3"), 0)
+	if _, ok := l.Get("b"); ok {
+		t.Fatal("b should be evicted")
+	}
+	if v, ok := l.Get("a"); !ok || string(v) != "1" {
+		t.Fatalf("a = %q, %v", v, ok)
+	}
+
+	l.Set("d", []byte("4"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := l.Get("d"); ok {
+		t.Fatal("d should be expired")
+	}
+}
+
+func TestFlightGroup(t *testing.T) {
+	var g flightGroup
+	var calls int32
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			g.Do("k", func() ([]byte, error) {
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(20 * time.Millisecond)
+				return []byte("v"), nil
+			})
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("calls = %d", calls)
+	}
+}
+
+// fakeStore 内存中的文档存储
+type fakeStore struct {
+	sync.Mutex
+	docs   map[string]bson.M
+	onFind func()
+}
+
+func (s *fakeStore) FindID(db string, collection string, id interface{}, result interface{}) error {
+	s.Lock()
+	doc, ok := s.docs[id.(string)]
+	s.Unlock()
+	if s.onFind != nil {
+		s.onFind()
+	}
+	if !ok {
+		return mgo.ErrNotFound
+	}
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, result)
+}
+
+func (s *fakeStore) UpdateID(db string, collection string, id interface{}, update interface{}) error {
+	s.Lock()
+	s.docs[id.(string)] = update.(bson.M)
+	s.Unlock()
+	return nil
+}
+
+func (s *fakeStore) UpsertID(db string, collection string, id interface{}, update interface{}) error {
+	return s.UpdateID(db, collection, id, update)
+}
+
+func (s *fakeStore) RemoveID(db string, collection string, id interface{}) error {
+	s.Lock()
+	delete(s.docs, id.(string))
+	s.Unlock()
+	return nil
+}
+
+func TestCacheContext(t *testing.T) {
+	store := &fakeStore{docs: map[string]bson.M{"a": {"n": 1}}}
+	c := newCacheContext(nil, store, NewLRUCache(10, 0), 0)
+	find := func() int {
+		doc := bson.M{}
+		if err := c.FindID("db", "c", "a", &doc); err != nil {
+			t.Fatal(err)
+		}
+		return doc["n"].(int)
+	}
+	if find() != 1 || find() != 1 {
+		t.Fatal("unexpected doc")
+	}
+	if st := c.Stats(); st.Hits != 1 || st.Misses != 1 || st.Loads != 1 {
+		t.Fatalf("stats = %+v", st)
+	}
+
+	c.UpdateID("db", "c", "a", bson.M{"n": 2})
+	if find() != 2 {
+		t.Fatal("update should invalidate cache")
+	}
+	c.RemoveID("db", "c", "a")
+	if err := c.FindID("db", "c", "a", &bson.M{}); err != mgo.ErrNotFound {
+		t.Fatalf("removed err = %v", err)
+	}
+	if st := c.Stats(); st.Invalid != 2 || st.Errors != 1 {
+		t.Fatalf("stats = %+v", st)
+	}
+}
+
+func TestCacheContextStaleLoad(t *testing.T) {
+	store := &fakeStore{docs: map[string]bson.M{"a": {"n": 1}}}
+	c := newCacheContext(nil, store, NewLRUCache(10, 0), 0)
+	// 加载读到旧文档后、写入缓存前发生更新
+	store.onFind = func() {
+		store.onFind = nil
+		c.UpdateID("db", "c", "a", bson.M{"n": 2})
+	}
+	doc := bson.M{}
+	c.FindID("db", "c", "a", &doc)
+	if doc["n"] != 1 {
+		t.Fatalf("first load = %v", doc)
+	}
+	doc = bson.M{}
+	c.FindID("db", "c", "a", &doc)
+	if doc["n"] != 2 {
+		t.Fatalf("stale document cached: %v", doc)
+	}
+	if len(c.gens) != 0 {
+		t.Fatalf("generation entries leaked: %d", len(c.gens))
+	}
+}
+
+func TestCacheContextReadYourWrites(t *testing.T) {
+	store := &fakeStore{docs: map[string]bson.M{"a": {"n": 1}}}
+	c := newCacheContext(nil, store, NewLRUCache(10, 0), 0)
+	// 第一次加载读到旧文档后阻塞，期间完成更新
+	loaded, release := make(chan struct{}), make(chan struct{})
+	store.onFind = func() {
+		store.onFind = nil
+		close(loaded)
+		<-release
+	}
+	done := make(chan struct{})
+	go func() {
+		c.FindID("db", "c", "a", &bson.M{})
+		close(done)
+	}()
+	<-loaded
+	c.UpdateID("db", "c", "a", bson.M{"n": 2})
+
+	// 更新之后开始的读取不能共享更新之前的加载
+	doc := bson.M{}
+	if err := c.FindID("db", "c", "a", &doc); err != nil || doc["n"] != 2 {
+		t.Fatalf("read after write = %v, %v", doc, err)
+	}
+	close(release)
+	<-done
+	if st := c.Stats(); st.Loads != 2 || st.Shared != 0 {
+		t.Fatalf("stats = %+v", st)
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	if cacheKey("db", "c", 1) == cacheKey("db", "c", "1") {
+		t.Fatal("ids of different types should not share a cache key")
+	}
+}
@@ -50,6 +50,7 @@ type DialContext struct {
 	sync.Mutex
 	// sessions SessionHeap
 	sessions chan *Session
+	retry    *RetryPolicy
 }
 
 // goroutine safe
@@ -113,6 +114,17 @@ func (c *DialContext) Close() {
 	c.Unlock()
 }
 
+// goroutine safe
+func (c *DialContext) Ping() error {
+	s := c.Ref()
+	defer c.UnRef(s)
+	err := s.Ping()
+	if err != nil {
+		s.Refresh()
+	}
+	return err
+}
+
 // goroutine safe
 func (c *DialContext) Ref() *Session {
 	// c.Lock()
@@ -139,56 +151,95 @@ func (c *DialContext) UnRef(s *Session) {
 
 // goroutine safe
 func (c *DialContext) EnsureCounter(db string, collection string, id string) error {
-	s := c.Ref()
-	defer c.UnRef(s)
-
-	err := s.DB(db).C(collection).Insert(bson.M{
-		"_id": id,
-		"seq": 0,
-	})
-	if mgo.IsDup(err) {
-		return nil
-	} else {
+	return c.Do(func(s *Session) error {
+		err := s.DB(db).C(collection).Insert(bson.M{
+			"_id": id,
+			"seq": 0,
+		})
+		if mgo.IsDup(err) {
+			return nil
+		}
 		return err
-	}
+	})
 }
 
 // goroutine safe
 func (c *DialContext) NextSeq(db string, collection string, id string) (int, error) {
-	s := c.Ref()
-	defer c.UnRef(s)
-
 	var res struct {
 		Seq int
 	}
-	_, err := s.DB(db).C(collection).FindId(id).Apply(mgo.Change{
-		Update:    bson.M{"$inc": bson.M{"seq": 1}},
-		ReturnNew: true,
-	}, &res)
+	err := c.DoOnce(func(s *Session) error {
+		_, err := s.DB(db).C(collection).FindId(id).Apply(mgo.Change{
+			Update:    bson.M{"$inc": bson.M{"seq": 1}},
+			ReturnNew: true,
+		}, &res)
+		return err
+	})
 
 	return res.Seq, err
 }
 
 // goroutine safe
 func (c *DialContext) EnsureIndex(db string, collection string, key []string) error {
-	s := c.Ref()
-	defer c.UnRef(s)
-
-	return s.DB(db).C(collection).EnsureIndex(mgo.Index{
-		Key:    key,
-		Unique: false,
-		Sparse: true,
+	return c.Do(func(s *Session) error {
+		return s.DB(db).C(collection).EnsureIndex(mgo.Index{
+			Key:    key,
+			Unique: false,
+			Sparse: true,
+		})
 	})
 }
 
 // goroutine safe
 func (c *DialContext) EnsureUniqueIndex(db string, collection string, key []string) error {
-	s := c.Ref()
-	defer c.UnRef(s)
+	return c.Do(func(s *Session) error {
+		return s.DB(db).C(collection).EnsureIndex(mgo.Index{
+			Key:    key,
+			Unique: true,
+			Sparse: true,
+		})
+	})
+}
+
+// goroutine safe
+func (c *DialContext) Insert(db string, collection string, docs ...interface{}) error {
+	return c.DoOnce(func(s *Session) error {
+		return s.DB(db).C(collection).Insert(docs...)
+	})
+}
+
+// goroutine safe
+func (c *DialContext) FindID(db string, collection string, id interface{}, result interface{}) error {
+	return c.Do(func(s *Session) error {
+		return s.DB(db).C(collection).FindId(id).One(result)
+	})
+}
 
-	return s.DB(db).C(collection).EnsureIndex(mgo.Index{
-		Key:    key,
-		Unique: true,
-		Sparse: true,
+// goroutine safe
+func (c *DialContext) UpdateID(db string, collection string, id interface{}, update interface{}) error {
+	return c.DoOnce(func(s *Session) error {
+		return s.DB(db).C(collection).UpdateId(id, update)
+	})
+}
+
+// goroutine safe
+func (c *DialContext) UpsertID(db string, collection string, id interface{}, update interface{}) error {
+	return c.DoOnce(func(s *Session) error {
+		_, err := s.DB(db).C(collection).UpsertId(id, update)
+		return err
+	})
+}
+
+// goroutine safe
+// 重试时上一次删除可能已经生效，此时的 ErrNotFound 视为成功
+func (c *DialContext) RemoveID(db string, collection string, id interface{}) error {
+	attempt := 0
+	return c.Do(func(s *Session) error {
+		attempt++
+		err := s.DB(db).C(collection).RemoveId(id)
+		if err == mgo.ErrNotFound && attempt > 1 {
+			return nil
+		}
+		return err
 	})
 }
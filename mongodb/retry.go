@@ -0,0 +1,145 @@
+package mongodb
+
+import (
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/skiplee85/common/utils"
+	"gopkg.in/mgo.v2"
+)
+
+// 主从切换、节点恢复等可重试的错误码
+var retryableCodes = map[int]bool{
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	10107: true, // NotMaster
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotMasterNoSlaveOk
+	13436: true, // NotMasterOrSecondary
+}
+
+var retryableMessages = []string{
+	"no reachable servers",
+	"not master",
+	"node is recovering",
+	"connection reset",
+	"broken pipe",
+	"closed explicitly",
+}
+
+// RetryPolicy 临时错误的重试策略
+type RetryPolicy struct {
+	MaxAttempts int              // 最多执行次数，包括第一次
+	BaseDelay   time.Duration    // 第一次重试的最大等待时间，之后指数增长
+	MaxDelay    time.Duration    // 单次等待时间上限
+	Retryable   func(error) bool // 错误分类，为 nil 时使用 IsRetryable
+}
+
+// DefaultRetryPolicy 默认重试策略，覆盖一次主从选举的时间
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    3 * time.Second,
+	}
+}
+
+// IsRetryable 是否为网络抖动、主从切换等临时错误
+func IsRetryable(err error) bool {
+	if err == nil || err == mgo.ErrNotFound {
+		return false
+	}
+	if err == io.EOF {
+		return true
+	}
+	switch e := err.(type) {
+	case *mgo.QueryError:
+		if retryableCodes[e.Code] {
+			return true
+		}
+	case *mgo.LastError:
+		if retryableCodes[e.Code] {
+			return true
+		}
+	}
+	msg := strings.ToLower(err.Error())
+	for _, m := range retryableMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetRetryPolicy 设置重试策略，nil 表示不重试。
+// 仅对幂等操作生效，NextSeq、Insert 等非幂等操作不会重试。
+func (c *DialContext) SetRetryPolicy(p *RetryPolicy) {
+	c.Lock()
+	c.retry = p
+	c.Unlock()
+}
+
+func (c *DialContext) retryPolicy() *RetryPolicy {
+	c.Lock()
+	defer c.Unlock()
+	return c.retry
+}
+
+// Do 执行幂等操作，遇到临时错误时刷新 session 并按重试策略重试。
+// goroutine safe
+func (c *DialContext) Do(fn func(s *Session) error) error {
+	p := c.retryPolicy()
+	if p == nil || p.MaxAttempts <= 1 {
+		return c.DoOnce(fn)
+	}
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+
+	var err error
+	for attempt := 0; attempt < p.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(p.backoff(attempt))
+		}
+		s := c.Ref()
+		err = fn(s)
+		if err != nil && retryable(err) {
+			s.Refresh()
+			c.UnRef(s)
+			log.Printf("mongo retryable error, attempt %d/%d. %s\n", attempt+1, p.MaxAttempts, err.Error())
+			continue
+		}
+		c.UnRef(s)
+		return err
+	}
+	return err
+}
+
+// DoOnce 执行非幂等操作，不重试，遇到临时错误时只刷新 session。
+// goroutine safe
+func (c *DialContext) DoOnce(fn func(s *Session) error) error {
+	s := c.Ref()
+	defer c.UnRef(s)
+
+	err := fn(s)
+	if IsRetryable(err) {
+		s.Refresh()
+	}
+	return err
+}
+
+// backoff 带随机抖动的指数退避
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.BaseDelay << uint(attempt-1)
+	if d <= 0 || (p.MaxDelay > 0 && d > p.MaxDelay) {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(utils.RandInt64(int64(d/2)+1))
+}
@@ -0,0 +1,35 @@
+package mongodb
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+func TestIsRetryable(t *testing.T) {
+	cases := map[error]bool{
+		io.EOF:                                  true,
+		errors.New("no reachable servers"):      true,
+		&mgo.QueryError{Code: 10107}:            true,
+		&mgo.LastError{Code: 11000, Err: "dup"}: false,
+		mgo.ErrNotFound:                         false,
+		nil:                                     false,
+	}
+	for err, want := range cases {
+		if got := IsRetryable(err); got != want {
+			t.Errorf("IsRetryable(%v) = %v, want %v", err, got, want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := &RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for attempt := 1; attempt < 10; attempt++ {
+		if d := p.backoff(attempt); d <= 0 || d > time.Second {
+			t.Fatalf("backoff(%d) = %v", attempt, d)
+		}
+	}
+}
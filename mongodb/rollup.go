@@ -0,0 +1,186 @@
+package mongodb
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/skiplee85/common/utils"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Granularity 统计周期
+type Granularity string
+
+const (
+	// GranularityDay 按天
+	GranularityDay Granularity = "day"
+	// GranularityWeek 按周，周一开始
+	GranularityWeek Granularity = "week"
+	// GranularityMonth 按月
+	GranularityMonth Granularity = "month"
+)
+
+// Start 获取 t 所在周期的开始时间，使用 t 的时区
+func (g Granularity) Start(t time.Time) time.Time {
+	switch g {
+	case GranularityWeek:
+		return utils.WeekStart(t)
+	case GranularityMonth:
+		return utils.MonthStart(t)
+	default:
+		return utils.DayStart(t)
+	}
+}
+
+// Next 获取下一个周期的开始时间，start 必须为周期开始时间
+func (g Granularity) Next(start time.Time) time.Time {
+	switch g {
+	case GranularityWeek:
+		return start.AddDate(0, 0, 7)
+	case GranularityMonth:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// RollupPoint 一个周期的统计值
+type RollupPoint struct {
+	Period time.Time      `json:"period"`
+	Counts map[string]int `json:"counts"`
+}
+
+type rollupDoc struct {
+	Period time.Time      `bson:"period"`
+	Counts map[string]int `bson:"counts"`
+}
+
+// Rollup 按天/周/月聚合计数器，每个周期一个文档
+type Rollup struct {
+	c          *DialContext
+	db         string
+	collection string
+	loc        *time.Location
+	grans      []Granularity
+}
+
+// NewRollup 创建聚合器，loc 为划分周期使用的时区，为 nil 时使用本地时区。
+// grans 为空时同时聚合天、周、月。
+func (c *DialContext) NewRollup(db string, collection string, loc *time.Location, grans ...Granularity) *Rollup {
+	if loc == nil {
+		loc = time.Local
+	}
+	if len(grans) == 0 {
+		grans = []Granularity{GranularityDay, GranularityWeek, GranularityMonth}
+	}
+	return &Rollup{
+		c:          c,
+		db:         db,
+		collection: collection,
+		loc:        loc,
+		grans:      grans,
+	}
+}
+
+// EnsureIndex 创建查询序列需要的索引
+func (r *Rollup) EnsureIndex() error {
+	return r.c.EnsureIndex(r.db, r.collection, []string{"key", "gran", "period"})
+}
+
+func (r *Rollup) docID(key string, g Granularity, start time.Time) string {
+	return fmt.Sprintf("%s|%s|%s", key, g, start.Format("20060102"))
+}
+
+// MaxRollupPoints Series 单次最多返回的周期数
+const MaxRollupPoints = 1000
+
+type rollupUpdate struct {
+	id     string
+	update bson.M
+}
+
+// updates 生成 t 所在各个周期的更新
+func (r *Rollup) updates(key string, t time.Time, counters map[string]int) []rollupUpdate {
+	inc := bson.M{}
+	for name, n := range counters {
+		inc["counts."+name] = n
+	}
+	t = t.In(r.loc)
+	ret := make([]rollupUpdate, 0, len(r.grans))
+	for _, g := range r.grans {
+		start := g.Start(t)
+		ret = append(ret, rollupUpdate{
+			id: r.docID(key, g, start),
+			update: bson.M{
+				"$inc": inc,
+				"$setOnInsert": bson.M{
+					"key":    key,
+					"gran":   g,
+					"period": start,
+				},
+			},
+		})
+	}
+	return ret
+}
+
+// Inc 在 t 所在的各个周期上累加计数器，counters 为空时不做任何操作
+// goroutine safe
+func (r *Rollup) Inc(key string, t time.Time, counters map[string]int) error {
+	if len(counters) == 0 {
+		return nil
+	}
+	for _, u := range r.updates(key, t, counters) {
+		if err := r.c.UpsertID(r.db, r.collection, u.id, u.update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Series 获取 [from, to] 之间的统计序列，没有数据的周期补零。
+// 周期数超过 MaxRollupPoints 时返回错误
+// goroutine safe
+func (r *Rollup) Series(key string, g Granularity, from time.Time, to time.Time) ([]RollupPoint, error) {
+	from = g.Start(from.In(r.loc))
+	to = g.Start(to.In(r.loc))
+	n := 0
+	for p := from; !p.After(to); p = g.Next(p) {
+		if n++; n > MaxRollupPoints {
+			return nil, fmt.Errorf("rollup series exceeds %d points", MaxRollupPoints)
+		}
+	}
+
+	docs := []rollupDoc{}
+	err := r.c.Do(func(s *Session) error {
+		return s.DB(r.db).C(r.collection).Find(bson.M{
+			"key":    key,
+			"gran":   g,
+			"period": bson.M{"$gte": from, "$lte": to},
+		}).All(&docs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fillSeries(g, from, to, docs), nil
+}
+
+// fillSeries 按周期排列统计值，没有数据的周期补零。from 和 to 必须为周期开始时间
+func fillSeries(g Granularity, from time.Time, to time.Time, docs []rollupDoc) []RollupPoint {
+	byPeriod := map[int64]map[string]int{}
+	for _, d := range docs {
+		byPeriod[d.Period.Unix()] = d.Counts
+	}
+	ret := []RollupPoint{}
+	for p := from; !p.After(to); p = g.Next(p) {
+		counts := byPeriod[p.Unix()]
+		if counts == nil {
+			counts = map[string]int{}
+		}
+		ret = append(ret, RollupPoint{
+			Period: p,
+			Counts: counts,
+		})
+	}
+	return ret
+}
@@ -0,0 +1,79 @@
+package mongodb
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestGranularityStart(t *testing.T) {
+	loc := time.FixedZone("CST", 8*3600)
+	// UTC 周日晚上在东八区已经是周一
+	ts := time.Date(2024, 3, 3, 23, 30, 0, 0, time.UTC).In(loc)
+	cases := []struct {
+		g    Granularity
+		want time.Time
+		next time.Time
+	}{
+		{GranularityDay, time.Date(2024, 3, 4, 0, 0, 0, 0, loc), time.Date(2024, 3, 5, 0, 0, 0, 0, loc)},
+		{GranularityWeek, time.Date(2024, 3, 4, 0, 0, 0, 0, loc), time.Date(2024, 3, 11, 0, 0, 0, 0, loc)},
+		{GranularityMonth, time.Date(2024, 3, 1, 0, 0, 0, 0, loc), time.Date(2024, 4, 1, 0, 0, 0, 0, loc)},
+	}
+	for _, cs := range cases {
+		start := cs.g.Start(ts)
+		if !start.Equal(cs.want) || !cs.g.Next(start).Equal(cs.next) {
+			t.Errorf("%s: start = %v, next = %v", cs.g, start, cs.g.Next(start))
+		}
+	}
+	// 周日属于上一周
+	if s := GranularityWeek.Start(time.Date(2024, 3, 10, 12, 0, 0, 0, loc)); !s.Equal(time.Date(2024, 3, 4, 0, 0, 0, 0, loc)) {
+		t.Errorf("sunday week start = %v", s)
+	}
+}
+
+func TestRollupUpdates(t *testing.T) {
+	loc := time.FixedZone("CST", 8*3600)
+	r := (&DialContext{}).NewRollup("db", "stats", loc)
+	us := r.updates("orders", time.Date(2024, 3, 3, 23, 30, 0, 0, time.UTC), map[string]int{"paid": 2})
+	ids := []string{"orders|day|20240304", "orders|week|20240304", "orders|month|20240301"}
+	if len(us) != len(ids) {
+		t.Fatalf("updates = %v", us)
+	}
+	for i, u := range us {
+		if u.id != ids[i] || u.update["$inc"].(bson.M)["counts.paid"] != 2 {
+			t.Errorf("update %d = %s %v", i, u.id, u.update)
+		}
+	}
+	// 空计数器不访问数据库
+	if err := r.Inc("orders", time.Now(), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFillSeries(t *testing.T) {
+	loc := time.FixedZone("CST", 8*3600)
+	day := func(d int) time.Time { return time.Date(2024, 2, d, 0, 0, 0, 0, loc) }
+	docs := []rollupDoc{
+		{Period: day(28).UTC(), Counts: map[string]int{"paid": 1}},
+		{Period: day(29).UTC(), Counts: map[string]int{"paid": 3}},
+	}
+	points := fillSeries(GranularityDay, day(27), time.Date(2024, 3, 1, 0, 0, 0, 0, loc), docs)
+	want := []int{0, 1, 3, 0}
+	if len(points) != len(want) {
+		t.Fatalf("points = %v", points)
+	}
+	for i, p := range points {
+		if p.Counts["paid"] != want[i] || p.Counts == nil {
+			t.Errorf("point %d = %v", i, p)
+		}
+	}
+	if !points[3].Period.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, loc)) {
+		t.Errorf("last period = %v", points[3].Period)
+	}
+
+	r := (&DialContext{}).NewRollup("db", "stats", loc)
+	if _, err := r.Series("orders", GranularityDay, day(1), day(1).AddDate(10, 0, 0)); err == nil {
+		t.Fatal("series over MaxRollupPoints should fail")
+	}
+}
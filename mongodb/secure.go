@@ -0,0 +1,697 @@
+package mongodb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/skiplee85/common/utils"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	secureTag    = "secure"
+	securePrefix = "enc:"
+	modeRandom   = "r"
+	modeDetermin = "d"
+)
+
+// Encryptor 字段加密器，加密带有 `secure:"true"` 或 `secure:"deterministic"` 标签的 string 字段。
+// 密文格式为 enc:v{版本}:{模式}:{base64}，旧版本的密钥保留后仍可解密，便于轮换密钥。
+// deterministic 模式下相同明文得到相同密文，可用于等值查询。
+type Encryptor struct {
+	sync.RWMutex
+	keys    map[int][]byte
+	current int
+}
+
+// NewEncryptor 创建加密器，key 长度必须为 16, 24 或者 32
+func NewEncryptor(version int, key []byte) (*Encryptor, error) {
+	e := &Encryptor{keys: map[int][]byte{}}
+	if err := e.AddKey(version, key); err != nil {
+		return nil, err
+	}
+	e.current = version
+	return e, nil
+}
+
+// AddKey 添加密钥，用于解密旧版本密文
+func (e *Encryptor) AddKey(version int, key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return fmt.Errorf("invalid key length %d", len(key))
+	}
+	e.Lock()
+	e.keys[version] = key
+	e.Unlock()
+	return nil
+}
+
+// SetCurrent 设置加密使用的密钥版本
+func (e *Encryptor) SetCurrent(version int) error {
+	e.Lock()
+	defer e.Unlock()
+	if _, ok := e.keys[version]; !ok {
+		return fmt.Errorf("key version %d not found", version)
+	}
+	e.current = version
+	return nil
+}
+
+// EncryptString 加密字符串
+func (e *Encryptor) EncryptString(plain string, deterministic bool) (string, error) {
+	e.RLock()
+	version, key := e.current, e.keys[e.current]
+	e.RUnlock()
+	return encryptString(plain, version, key, deterministic)
+}
+
+func encryptString(plain string, version int, key []byte, deterministic bool) (string, error) {
+	var (
+		encrypted []byte
+		err       error
+		mode      = modeRandom
+	)
+	if deterministic {
+		mode = modeDetermin
+		encrypted, err = utils.AesEncryptCFBWithIV([]byte(plain), key, deterministicIV(key, plain))
+	} else {
+		encrypted, err = utils.AesEncryptCFB([]byte(plain), key)
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%sv%d:%s:%s", securePrefix, version, mode, base64.StdEncoding.EncodeToString(encrypted)), nil
+}
+
+func deterministicIV(key []byte, plain string) []byte {
+	k := sha256.Sum256(append([]byte("iv:"), key...))
+	h := hmac.New(sha256.New, k[:])
+	h.Write([]byte(plain))
+	return h.Sum(nil)[:16]
+}
+
+// DecryptString 解密字符串，非密文格式的值原样返回，便于存量明文数据迁移。
+func (e *Encryptor) DecryptString(s string) (string, error) {
+	if !strings.HasPrefix(s, securePrefix) {
+		return s, nil
+	}
+	parts := strings.SplitN(s[len(securePrefix):], ":", 3)
+	if len(parts) != 3 || !strings.HasPrefix(parts[0], "v") {
+		return "", fmt.Errorf("invalid ciphertext")
+	}
+	version, err := strconv.Atoi(parts[0][1:])
+	if err != nil {
+		return "", fmt.Errorf("invalid ciphertext version %s", parts[0])
+	}
+	e.RLock()
+	key, ok := e.keys[version]
+	e.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("key version %d not found", version)
+	}
+	encrypted, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+	decrypted, err := utils.AesDecryptCFB(encrypted, key)
+	if err != nil {
+		return "", err
+	}
+	return string(decrypted), nil
+}
+
+// EqualIn 生成 deterministic 字段的等值查询条件，匹配所有密钥版本加密的密文。
+// 例如 in, _ := e.EqualIn("13800000000"); query := bson.M{"phone": in}
+func (e *Encryptor) EqualIn(plain string) (bson.M, error) {
+	e.RLock()
+	defer e.RUnlock()
+	in := []string{}
+	for version, key := range e.keys {
+		s, err := encryptString(plain, version, key, true)
+		if err != nil {
+			return nil, err
+		}
+		in = append(in, s)
+	}
+	return bson.M{"$in": in}, nil
+}
+
+// Encrypt 返回加密后的文档副本，不修改传入的文档。非结构体文档原样返回。
+func (e *Encryptor) Encrypt(doc interface{}) (interface{}, error) {
+	if doc == nil {
+		return nil, nil
+	}
+	v := reflect.ValueOf(doc)
+	if !hasSecureField(v.Type()) {
+		return doc, nil
+	}
+	nv, err := e.encryptValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return nv.Interface(), nil
+}
+
+func (e *Encryptor) encryptValue(v reflect.Value) (reflect.Value, error) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v, nil
+		}
+		ev, err := e.encryptValue(v.Elem())
+		if err != nil {
+			return v, err
+		}
+		nv := reflect.New(v.Type().Elem())
+		nv.Elem().Set(ev)
+		return nv, nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return v, nil
+		}
+		nv := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			ev, err := e.encryptValue(v.Index(i))
+			if err != nil {
+				return v, err
+			}
+			nv.Index(i).Set(ev)
+		}
+		return nv, nil
+	case reflect.Struct:
+		nv := reflect.New(v.Type()).Elem()
+		nv.Set(v)
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			fv := nv.Field(i)
+			if mode := secureMode(f); mode != "" {
+				if fv.String() == "" {
+					continue
+				}
+				s, err := e.EncryptString(fv.String(), mode == "deterministic")
+				if err != nil {
+					return v, err
+				}
+				fv.SetString(s)
+			} else if hasSecureField(f.Type) {
+				ev, err := e.encryptValue(fv)
+				if err != nil {
+					return v, err
+				}
+				fv.Set(ev)
+			}
+		}
+		return nv, nil
+	}
+	return v, nil
+}
+
+// Decrypt 原地解密文档，doc 必须为指针，可以是结构体或结构体切片。
+func (e *Encryptor) Decrypt(doc interface{}) error {
+	v := reflect.ValueOf(doc)
+	if v.Kind() != reflect.Ptr {
+		return fmt.Errorf("decrypt: non-pointer %s", v.Type())
+	}
+	if !hasSecureField(v.Type()) {
+		return nil
+	}
+	return e.decryptValue(v)
+}
+
+func (e *Encryptor) decryptValue(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return e.decryptValue(v.Elem())
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := e.decryptValue(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			fv := v.Field(i)
+			if secureMode(f) != "" {
+				s, err := e.DecryptString(fv.String())
+				if err != nil {
+					return fmt.Errorf("decrypt %s.%s: %v", t.Name(), f.Name, err)
+				}
+				fv.SetString(s)
+			} else if hasSecureField(f.Type) {
+				if err := e.decryptValue(fv); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+var secureTypes sync.Map
+
+// secureMode 字段的加密模式，空表示不加密
+func secureMode(f reflect.StructField) string {
+	mode := f.Tag.Get(secureTag)
+	if mode == "" || mode == "false" || f.Type.Kind() != reflect.String {
+		return ""
+	}
+	return mode
+}
+
+// hasSecureField 类型中是否有需要加密的字段
+func hasSecureField(t reflect.Type) bool {
+	if v, ok := secureTypes.Load(t); ok {
+		return v.(bool)
+	}
+	ret := scanSecureField(t, map[reflect.Type]bool{})
+	secureTypes.Store(t, ret)
+	return ret
+}
+
+func scanSecureField(t reflect.Type, visiting map[reflect.Type]bool) bool {
+	// 递归类型只检查一次
+	if visiting[t] {
+		return false
+	}
+	visiting[t] = true
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice:
+		return scanSecureField(t.Elem(), visiting)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			if secureMode(f) != "" {
+				return true
+			}
+			if scanSecureField(f.Type, visiting) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SecureContext 带字段加密的 DialContext。
+// 写入的结构体文档按 secure 标签加密，FindID 读取后自动解密。
+// 使用 bson.M、bson.D 或 map 写入时需要先通过 Register 登记集合的文档结构，
+// 无法检查的文档或更新会被拒绝，不会以明文写入。
+type SecureContext struct {
+	*DialContext
+	Encryptor *Encryptor
+
+	mu      sync.RWMutex
+	schemas map[string]map[string]string
+}
+
+// WithEncryptor 在 DialContext 上启用字段加密
+func (c *DialContext) WithEncryptor(e *Encryptor) *SecureContext {
+	return &SecureContext{
+		DialContext: c,
+		Encryptor:   e,
+		schemas:     map[string]map[string]string{},
+	}
+}
+
+// WithTenants 启用多租户路由，租户的读写同样加密
+func (c *SecureContext) WithTenants(resolve TenantResolver) *Tenants {
+	return NewTenants(c, resolve)
+}
+
+// Register 登记集合的文档结构，model 为结构体或结构体指针。
+// Insert/UpdateID/UpsertID 根据结构加密 map 文档中对应 secure 字段的值
+func (c *SecureContext) Register(collection string, model interface{}) {
+	schema := map[string]string{}
+	securePaths(reflect.TypeOf(model), "", schema, map[reflect.Type]bool{})
+	c.mu.Lock()
+	c.schemas[collection] = schema
+	c.mu.Unlock()
+}
+
+// securePaths 收集 secure 字段的 bson 路径，切片元素与切片使用同一路径
+func securePaths(t reflect.Type, prefix string, paths map[string]string, visiting map[reflect.Type]bool) {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || visiting[t] {
+		return
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("bson"), ",")
+		name := tag[0]
+		if name == "-" {
+			continue
+		}
+		inline := false
+		for _, opt := range tag[1:] {
+			inline = inline || opt == "inline"
+		}
+		path := prefix
+		if !inline {
+			if name == "" {
+				name = strings.ToLower(f.Name)
+			}
+			path = joinPath(prefix, name)
+		}
+		if mode := secureMode(f); mode != "" {
+			paths[path] = mode
+		} else if hasSecureField(f.Type) {
+			securePaths(f.Type, path, paths, visiting)
+		}
+	}
+}
+
+func joinPath(prefix string, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// normalizePath 去掉更新路径中的数组下标和位置操作符，如 contacts.$.phone -> contacts.phone
+func normalizePath(path string) string {
+	parts := strings.Split(path, ".")
+	ret := parts[:0]
+	for _, p := range parts {
+		if strings.HasPrefix(p, "$") {
+			continue
+		}
+		if _, err := strconv.Atoi(p); err == nil {
+			continue
+		}
+		ret = append(ret, p)
+	}
+	return strings.Join(ret, ".")
+}
+
+// goroutine safe
+func (c *SecureContext) Insert(db string, collection string, docs ...interface{}) error {
+	encrypted := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		ed, err := c.encryptDoc(collection, doc)
+		if err != nil {
+			return err
+		}
+		encrypted[i] = ed
+	}
+	return c.DialContext.Insert(db, collection, encrypted...)
+}
+
+// goroutine safe
+func (c *SecureContext) FindID(db string, collection string, id interface{}, result interface{}) error {
+	if err := c.DialContext.FindID(db, collection, id, result); err != nil {
+		return err
+	}
+	return c.Encryptor.Decrypt(result)
+}
+
+// goroutine safe
+func (c *SecureContext) UpdateID(db string, collection string, id interface{}, update interface{}) error {
+	update, err := c.encryptUpdate(collection, update)
+	if err != nil {
+		return err
+	}
+	return c.DialContext.UpdateID(db, collection, id, update)
+}
+
+// goroutine safe
+func (c *SecureContext) UpsertID(db string, collection string, id interface{}, update interface{}) error {
+	update, err := c.encryptUpdate(collection, update)
+	if err != nil {
+		return err
+	}
+	return c.DialContext.UpsertID(db, collection, id, update)
+}
+
+func (c *SecureContext) schema(collection string) (map[string]string, bool) {
+	c.mu.RLock()
+	schema, ok := c.schemas[collection]
+	c.mu.RUnlock()
+	return schema, ok
+}
+
+// toDoc 将 bson.M、bson.D 和 key 为 string 的 map 转为 bson.M，其他类型返回 false
+func toDoc(v interface{}) (bson.M, bool) {
+	switch d := v.(type) {
+	case bson.M:
+		return d, true
+	case map[string]interface{}:
+		return bson.M(d), true
+	case bson.D:
+		m := bson.M{}
+		for _, e := range d {
+			m[e.Name] = e.Value
+		}
+		return m, true
+	case *bson.D:
+		if d == nil {
+			return nil, false
+		}
+		return toDoc(*d)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Map || rv.Type().Key().Kind() != reflect.String {
+		return nil, false
+	}
+	m := bson.M{}
+	for _, k := range rv.MapKeys() {
+		m[k.String()] = rv.MapIndex(k).Interface()
+	}
+	return m, true
+}
+
+func isStruct(v interface{}) bool {
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t != nil && t.Kind() == reflect.Struct
+}
+
+// encryptDoc 加密写入的整个文档。结构体按 secure 标签加密，集合登记过时还会按登记的结构检查；
+// map 文档必须先登记集合，其他类型的文档拒绝写入
+func (c *SecureContext) encryptDoc(collection string, doc interface{}) (interface{}, error) {
+	schema, ok := c.schema(collection)
+	if _, isDoc := toDoc(doc); isDoc {
+		if !ok {
+			return nil, fmt.Errorf("secure: collection %s not registered, cannot encrypt %T", collection, doc)
+		}
+		return c.encryptField(schema, "", doc)
+	}
+	if !isStruct(doc) {
+		return nil, fmt.Errorf("secure: cannot inspect document %T", doc)
+	}
+	if ok {
+		return c.encryptField(schema, "", doc)
+	}
+	return c.Encryptor.Encrypt(doc)
+}
+
+// encryptUpdate 加密整文档替换，或更新操作符中对应 secure 字段的值。
+// map 更新的集合没有登记时拒绝更新，避免明文写入
+func (c *SecureContext) encryptUpdate(collection string, update interface{}) (interface{}, error) {
+	m, ok := toDoc(update)
+	if !ok {
+		return c.encryptDoc(collection, update)
+	}
+	schema, ok := c.schema(collection)
+	if !ok {
+		return nil, fmt.Errorf("secure: collection %s not registered, cannot encrypt %T update", collection, update)
+	}
+	nm := bson.M{}
+	for k, v := range m {
+		var (
+			ev  interface{}
+			err error
+		)
+		if strings.HasPrefix(k, "$") {
+			ev, err = c.encryptOperator(schema, k, v)
+		} else {
+			// 整文档替换
+			ev, err = c.encryptField(schema, k, v)
+		}
+		if err != nil {
+			return nil, err
+		}
+		nm[k] = ev
+	}
+	return nm, nil
+}
+
+// encryptOperator 加密更新操作符的参数，如 {"$set": {"phone": "..."}}
+func (c *SecureContext) encryptOperator(schema map[string]string, op string, v interface{}) (interface{}, error) {
+	fields, ok := toDoc(v)
+	if !ok {
+		return nil, fmt.Errorf("secure: cannot inspect %s argument %T", op, v)
+	}
+	switch op {
+	case "$set", "$setOnInsert", "$push", "$addToSet":
+	case "$min", "$max":
+		// 密文无法比较大小
+		for k := range fields {
+			if schemaHas(schema, normalizePath(k)) {
+				return nil, fmt.Errorf("secure: %s on secure field %s is not supported", op, k)
+			}
+		}
+		return fields, nil
+	default:
+		// $unset、$inc 等不写入字符串值
+		return fields, nil
+	}
+	nm := bson.M{}
+	for k, fv := range fields {
+		if each, ok := toDoc(fv); ok && (op == "$push" || op == "$addToSet") {
+			// {"$push": {"contacts": {"$each": [...]}}}
+			if items, ok := each["$each"]; ok {
+				ne := bson.M{}
+				for ek, ev := range each {
+					ne[ek] = ev
+				}
+				ei, err := c.encryptField(schema, k, items)
+				if err != nil {
+					return nil, err
+				}
+				ne["$each"] = ei
+				nm[k] = ne
+				continue
+			}
+		}
+		ev, err := c.encryptField(schema, k, fv)
+		if err != nil {
+			return nil, err
+		}
+		nm[k] = ev
+	}
+	return nm, nil
+}
+
+// encryptField 加密写入 path 的值。值可以是字符串、map、bson.D、结构体或它们的切片，
+// path 下有 secure 字段但值无法检查时返回错误
+func (c *SecureContext) encryptField(schema map[string]string, path string, v interface{}) (interface{}, error) {
+	np := normalizePath(path)
+	if mode, ok := schema[np]; ok {
+		switch s := v.(type) {
+		case string:
+			if s == "" {
+				return s, nil
+			}
+			return c.Encryptor.EncryptString(s, mode == "deterministic")
+		case []string:
+			ret := make([]string, len(s))
+			for i, item := range s {
+				es, err := c.Encryptor.EncryptString(item, mode == "deterministic")
+				if err != nil {
+					return nil, err
+				}
+				ret[i] = es
+			}
+			return ret, nil
+		case []interface{}:
+			ret := make([]interface{}, len(s))
+			for i, item := range s {
+				ev, err := c.encryptField(schema, path, item)
+				if err != nil {
+					return nil, err
+				}
+				ret[i] = ev
+			}
+			return ret, nil
+		case nil:
+			return nil, nil
+		}
+		return nil, fmt.Errorf("secure: cannot encrypt %T for field %s", v, path)
+	}
+	if v == nil || !schemaHasPrefix(schema, np) {
+		return v, nil
+	}
+	if fv, ok := toDoc(v); ok {
+		nm := bson.M{}
+		for k, item := range fv {
+			ev, err := c.encryptField(schema, joinPath(path, k), item)
+			if err != nil {
+				return nil, err
+			}
+			nm[k] = ev
+		}
+		return nm, nil
+	}
+	rv := reflect.ValueOf(v)
+	if hasSecureField(rv.Type()) {
+		return c.Encryptor.Encrypt(v)
+	}
+	if isStruct(v) {
+		// 没有 secure 标签的结构体按登记的结构加密
+		if rv.Kind() == reflect.Ptr && rv.IsNil() {
+			return v, nil
+		}
+		data, err := bson.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("secure: cannot inspect %T for field %s: %v", v, path, err)
+		}
+		m := bson.M{}
+		if err := bson.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+		return c.encryptField(schema, path, m)
+	}
+	if (rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array) && rv.Type().Elem().Kind() != reflect.Uint8 {
+		ret := make([]interface{}, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			ev, err := c.encryptField(schema, path, rv.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			ret[i] = ev
+		}
+		return ret, nil
+	}
+	if rv.Kind() == reflect.Ptr {
+		return nil, fmt.Errorf("secure: cannot inspect %T for field %s", v, path)
+	}
+	return v, nil
+}
+
+func schemaHas(schema map[string]string, path string) bool {
+	_, ok := schema[path]
+	return ok || schemaHasPrefix(schema, path)
+}
+
+// schemaHasPrefix path 下是否有 secure 字段
+func schemaHasPrefix(schema map[string]string, path string) bool {
+	if path == "" {
+		return len(schema) > 0
+	}
+	for p := range schema {
+		if strings.HasPrefix(p, path+".") {
+			return true
+		}
+	}
+	return false
+}
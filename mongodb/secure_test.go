@@ -0,0 +1,210 @@
+package mongodb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type secureContact struct {
+	Name  string
+	Phone string `secure:"true"`
+}
+
+type secureUser struct {
+	ID       string          `bson:"_id"`
+	Phone    string          `bson:"phone" secure:"deterministic"`
+	IDCard   string          `bson:"idcard" secure:"true"`
+	Nick     string          `bson:"nick"`
+	Contacts []secureContact `bson:"contacts"`
+	Backup   *secureContact  `bson:"backup"`
+}
+
+func newTestEncryptor(t *testing.T) *Encryptor {
+	e, err := NewEncryptor(1, []byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	e := newTestEncryptor(t)
+	u := &secureUser{
+		Phone:    "13800000000",
+		IDCard:   "11010519491231002X",
+		Nick:     "nick",
+		Contacts: []secureContact{{Name: "a", Phone: "13900000000"}},
+		Backup:   &secureContact{Phone: "13700000000"},
+	}
+	v, err := e.Encrypt(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eu := v.(*secureUser)
+	if u.Phone != "13800000000" || u.Contacts[0].Phone != "13900000000" {
+		t.Fatal("Encrypt should not modify the original document")
+	}
+	for _, s := range []string{eu.Phone, eu.IDCard, eu.Contacts[0].Phone, eu.Backup.Phone} {
+		if !strings.HasPrefix(s, "enc:v1:") {
+			t.Fatalf("not encrypted: %s", s)
+		}
+	}
+	if eu.Nick != "nick" || eu.Contacts[0].Name != "a" {
+		t.Fatal("plain fields should not be encrypted")
+	}
+
+	if err := e.Decrypt(eu); err != nil {
+		t.Fatal(err)
+	}
+	if eu.Phone != u.Phone || eu.IDCard != u.IDCard || eu.Contacts[0].Phone != "13900000000" || eu.Backup.Phone != "13700000000" {
+		t.Fatalf("decrypt = %+v", eu)
+	}
+
+	// 存量明文数据原样返回
+	if s, err := e.DecryptString("13800000000"); err != nil || s != "13800000000" {
+		t.Fatalf("plaintext = %s, %v", s, err)
+	}
+}
+
+func TestEncryptorRotation(t *testing.T) {
+	e := newTestEncryptor(t)
+	old, _ := e.EncryptString("13800000000", true)
+	a, _ := e.EncryptString("x", false)
+	b, _ := e.EncryptString("x", false)
+	if a == b {
+		t.Fatal("random mode should produce different ciphertexts")
+	}
+
+	if err := e.AddKey(2, []byte("fedcba9876543210fedcba9876543210")); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetCurrent(2); err != nil {
+		t.Fatal(err)
+	}
+	cur, _ := e.EncryptString("13800000000", true)
+	if !strings.HasPrefix(cur, "enc:v2:d:") || cur == old {
+		t.Fatalf("ciphertext after rotation = %s", cur)
+	}
+	for _, s := range []string{old, cur} {
+		if p, err := e.DecryptString(s); err != nil || p != "13800000000" {
+			t.Fatalf("decrypt %s = %s, %v", s, p, err)
+		}
+	}
+	in, err := e.EqualIn("13800000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for _, s := range in["$in"].([]string) {
+		got[s] = true
+	}
+	if len(got) != 2 || !got[old] || !got[cur] {
+		t.Fatalf("EqualIn = %v", in)
+	}
+	if err := e.SetCurrent(3); err == nil {
+		t.Fatal("SetCurrent should fail for unknown version")
+	}
+}
+
+func TestEncryptUpdate(t *testing.T) {
+	e := newTestEncryptor(t)
+	c := (&DialContext{}).WithEncryptor(e)
+	if _, err := c.encryptUpdate("users", bson.M{"$set": bson.M{"phone": "13800000000"}}); err == nil {
+		t.Fatal("unregistered collection should be rejected")
+	}
+	c.Register("users", secureUser{})
+
+	update := bson.M{
+		"$set": bson.M{
+			"phone":            "13800000000",
+			"nick":             "nick",
+			"contacts.0.phone": "13900000000",
+			"backup":           bson.M{"phone": "13700000000", "name": "b"},
+		},
+		"$push": bson.M{"contacts": bson.M{"$each": []secureContact{{Phone: "13600000000"}}}},
+		"$inc":  bson.M{"n": 1},
+	}
+	v, err := c.encryptUpdate("users", update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := v.(bson.M)["$set"].(bson.M)
+	for _, s := range []string{set["phone"].(string), set["contacts.0.phone"].(string), set["backup"].(bson.M)["phone"].(string)} {
+		if !strings.HasPrefix(s, "enc:") {
+			t.Fatalf("not encrypted: %s", s)
+		}
+	}
+	if set["nick"] != "nick" || set["backup"].(bson.M)["name"] != "b" {
+		t.Fatal("plain fields should not be encrypted")
+	}
+	pushed := v.(bson.M)["$push"].(bson.M)["contacts"].(bson.M)["$each"].([]secureContact)
+	if !strings.HasPrefix(pushed[0].Phone, "enc:") {
+		t.Fatalf("pushed = %+v", pushed)
+	}
+	if update["$set"].(bson.M)["phone"] != "13800000000" {
+		t.Fatal("encryptUpdate should not modify the original update")
+	}
+
+	if _, err := c.encryptUpdate("users", bson.M{"$set": bson.M{"phone": 1}}); err == nil {
+		t.Fatal("non-string value for secure field should be rejected")
+	}
+	if _, err := c.encryptUpdate("users", bson.M{"$max": bson.M{"phone": "1"}}); err == nil {
+		t.Fatal("$max on secure field should be rejected")
+	}
+
+	// bson.D、普通 map 和没有 secure 标签的结构体同样按登记的结构加密
+	type plainContact struct {
+		Phone string `bson:"phone"`
+	}
+	shapes := []interface{}{
+		bson.D{{Name: "$set", Value: bson.D{{Name: "phone", Value: "13800000000"}}}},
+		map[string]interface{}{"$set": map[string]interface{}{"phone": "13800000000"}},
+		bson.M{"$set": map[string]interface{}{"phone": "13800000000"}},
+		bson.M{"$set": bson.M{"backup": plainContact{Phone: "13800000000"}}},
+		bson.M{"$set": bson.M{"contacts": []map[string]string{{"phone": "13800000000"}}}},
+	}
+	for _, u := range shapes {
+		v, err := c.encryptUpdate("users", u)
+		if err != nil {
+			t.Fatalf("%#v: %v", u, err)
+		}
+		if strings.Contains(fmt.Sprint(v), "13800000000") {
+			t.Fatalf("%#v: plaintext written: %v", u, v)
+		}
+	}
+	for _, u := range []interface{}{
+		bson.M{"$set": "phone"},
+		bson.Raw{Kind: 3},
+		[]byte("{}"),
+	} {
+		if _, err := c.encryptUpdate("users", u); err == nil {
+			t.Fatalf("%#v should be rejected", u)
+		}
+	}
+}
+
+func TestEncryptDoc(t *testing.T) {
+	c := (&DialContext{}).WithEncryptor(newTestEncryptor(t))
+	doc := bson.M{"_id": "u1", "phone": "13800000000", "contacts": []interface{}{bson.M{"phone": "13900000000"}}}
+	if _, err := c.encryptDoc("users", doc); err == nil {
+		t.Fatal("map document for unregistered collection should be rejected")
+	}
+	if _, err := c.encryptDoc("users", "u1"); err == nil {
+		t.Fatal("non-document should be rejected")
+	}
+	if v, err := c.encryptDoc("users", &secureUser{Phone: "13800000000"}); err != nil || !strings.HasPrefix(v.(*secureUser).Phone, "enc:") {
+		t.Fatalf("struct = %v, %v", v, err)
+	}
+
+	c.Register("users", secureUser{})
+	v, err := c.encryptDoc("users", doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := fmt.Sprint(v); strings.Contains(s, "13800000000") || strings.Contains(s, "13900000000") || !strings.Contains(s, "u1") {
+		t.Fatalf("doc = %v", v)
+	}
+}
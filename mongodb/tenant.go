@@ -0,0 +1,188 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/skiplee85/common/tenant"
+)
+
+var tenantIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,48}$`)
+
+// TenantResolver 根据租户ID解析数据库名
+type TenantResolver func(tenantID string) (string, error)
+
+// PrefixResolver 数据库名为 prefix + 租户ID
+func PrefixResolver(prefix string) TenantResolver {
+	return func(tenantID string) (string, error) {
+		if !tenantIDPattern.MatchString(tenantID) {
+			return "", fmt.Errorf("invalid tenant id %q", tenantID)
+		}
+		return prefix + tenantID, nil
+	}
+}
+
+// WithTenant 将租户ID写入 context，同 tenant.NewContext
+func WithTenant(ctx context.Context, tenantID string) context.Context {
+	return tenant.NewContext(ctx, tenantID)
+}
+
+// TenantFromContext 从 context 读取租户ID，同 tenant.FromContext
+func TenantFromContext(ctx context.Context) (string, bool) {
+	return tenant.FromContext(ctx)
+}
+
+// TenantCounter 租户初始化时创建的计数器
+type TenantCounter struct {
+	Collection string
+	ID         string
+}
+
+// TenantIndex 租户初始化时创建的索引
+type TenantIndex struct {
+	Collection string
+	Key        []string
+	Unique     bool
+}
+
+// TenantSpec 新租户需要初始化的计数器和索引
+type TenantSpec struct {
+	Counters []TenantCounter
+	Indexes  []TenantIndex
+}
+
+// TenantBackend Tenants 使用的数据库操作，DialContext、SecureContext 和 CacheContext 都实现了该接口
+type TenantBackend interface {
+	EnsureCounter(db string, collection string, id string) error
+	NextSeq(db string, collection string, id string) (int, error)
+	EnsureIndex(db string, collection string, key []string) error
+	EnsureUniqueIndex(db string, collection string, key []string) error
+	Insert(db string, collection string, docs ...interface{}) error
+	FindID(db string, collection string, id interface{}, result interface{}) error
+	UpdateID(db string, collection string, id interface{}, update interface{}) error
+	UpsertID(db string, collection string, id interface{}, update interface{}) error
+	RemoveID(db string, collection string, id interface{}) error
+}
+
+// Tenants 多租户路由，每个租户使用独立的数据库
+type Tenants struct {
+	c       TenantBackend
+	resolve TenantResolver
+}
+
+// NewTenants 在 backend 上启用多租户路由，租户的读写都经过 backend
+func NewTenants(backend TenantBackend, resolve TenantResolver) *Tenants {
+	return &Tenants{
+		c:       backend,
+		resolve: resolve,
+	}
+}
+
+// WithTenants 启用多租户路由
+func (c *DialContext) WithTenants(resolve TenantResolver) *Tenants {
+	return NewTenants(c, resolve)
+}
+
+// DB 获取租户数据库
+func (t *Tenants) DB(tenantID string) (*TenantDB, error) {
+	db, err := t.resolve(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return &TenantDB{
+		c:        t.c,
+		db:       db,
+		TenantID: tenantID,
+	}, nil
+}
+
+// FromContext 获取 context 中租户的数据库
+func (t *Tenants) FromContext(ctx context.Context) (*TenantDB, error) {
+	id, ok := TenantFromContext(ctx)
+	if !ok {
+		return nil, fmt.Errorf("tenant not found in context")
+	}
+	return t.DB(id)
+}
+
+// Provision 初始化新租户的索引和计数器，可重复调用
+func (t *Tenants) Provision(tenantID string, spec *TenantSpec) error {
+	tdb, err := t.DB(tenantID)
+	if err != nil {
+		return err
+	}
+	for _, idx := range spec.Indexes {
+		if idx.Unique {
+			err = tdb.EnsureUniqueIndex(idx.Collection, idx.Key)
+		} else {
+			err = tdb.EnsureIndex(idx.Collection, idx.Key)
+		}
+		if err != nil {
+			return fmt.Errorf("tenant %s index %s %v: %v", tenantID, idx.Collection, idx.Key, err)
+		}
+	}
+	for _, counter := range spec.Counters {
+		if err = tdb.EnsureCounter(counter.Collection, counter.ID); err != nil {
+			return fmt.Errorf("tenant %s counter %s/%s: %v", tenantID, counter.Collection, counter.ID, err)
+		}
+	}
+	return nil
+}
+
+// TenantDB 限定在某个租户数据库上的操作
+type TenantDB struct {
+	c        TenantBackend
+	db       string
+	TenantID string
+}
+
+// Name 数据库名
+func (t *TenantDB) Name() string {
+	return t.db
+}
+
+// goroutine safe
+func (t *TenantDB) EnsureCounter(collection string, id string) error {
+	return t.c.EnsureCounter(t.db, collection, id)
+}
+
+// goroutine safe
+func (t *TenantDB) NextSeq(collection string, id string) (int, error) {
+	return t.c.NextSeq(t.db, collection, id)
+}
+
+// goroutine safe
+func (t *TenantDB) EnsureIndex(collection string, key []string) error {
+	return t.c.EnsureIndex(t.db, collection, key)
+}
+
+// goroutine safe
+func (t *TenantDB) EnsureUniqueIndex(collection string, key []string) error {
+	return t.c.EnsureUniqueIndex(t.db, collection, key)
+}
+
+// goroutine safe
+func (t *TenantDB) Insert(collection string, docs ...interface{}) error {
+	return t.c.Insert(t.db, collection, docs...)
+}
+
+// goroutine safe
+func (t *TenantDB) FindID(collection string, id interface{}, result interface{}) error {
+	return t.c.FindID(t.db, collection, id, result)
+}
+
+// goroutine safe
+func (t *TenantDB) UpdateID(collection string, id interface{}, update interface{}) error {
+	return t.c.UpdateID(t.db, collection, id, update)
+}
+
+// goroutine safe
+func (t *TenantDB) UpsertID(collection string, id interface{}, update interface{}) error {
+	return t.c.UpsertID(t.db, collection, id, update)
+}
+
+// goroutine safe
+func (t *TenantDB) RemoveID(collection string, id interface{}) error {
+	return t.c.RemoveID(t.db, collection, id)
+}
@@ -0,0 +1,94 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeTenantBackend 记录调用的数据库，EnsureIndex 按集合返回错误
+type fakeTenantBackend struct {
+	TenantBackend
+	dbs      []string
+	indexErr map[string]error
+}
+
+func (b *fakeTenantBackend) EnsureIndex(db string, collection string, key []string) error {
+	b.dbs = append(b.dbs, db)
+	return b.indexErr[collection]
+}
+
+func (b *fakeTenantBackend) EnsureUniqueIndex(db string, collection string, key []string) error {
+	return b.EnsureIndex(db, collection, key)
+}
+
+func (b *fakeTenantBackend) EnsureCounter(db string, collection string, id string) error {
+	b.dbs = append(b.dbs, db)
+	return nil
+}
+
+func TestPrefixResolver(t *testing.T) {
+	resolve := PrefixResolver("t_")
+	if db, err := resolve("acme-1"); err != nil || db != "t_acme-1" {
+		t.Fatalf("db = %s, %v", db, err)
+	}
+	for _, id := range []string{"", "a.b", "a/b", "a$b", strings.Repeat("a", 49)} {
+		if _, err := resolve(id); err == nil {
+			t.Errorf("tenant id %q should be rejected", id)
+		}
+	}
+}
+
+func TestTenants(t *testing.T) {
+	b := &fakeTenantBackend{indexErr: map[string]error{}}
+	tenants := &Tenants{c: b, resolve: PrefixResolver("t_")}
+
+	if _, err := tenants.FromContext(context.Background()); err == nil {
+		t.Fatal("missing tenant should fail")
+	}
+	tdb, err := tenants.FromContext(WithTenant(context.Background(), "acme"))
+	if err != nil || tdb.Name() != "t_acme" || tdb.TenantID != "acme" {
+		t.Fatalf("tenant db = %+v, %v", tdb, err)
+	}
+
+	spec := &TenantSpec{
+		Indexes:  []TenantIndex{{Collection: "users", Key: []string{"name"}, Unique: true}},
+		Counters: []TenantCounter{{Collection: "counters", ID: "users"}},
+	}
+	if err := tenants.Provision("acme", spec); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.dbs) != 2 || b.dbs[0] != "t_acme" || b.dbs[1] != "t_acme" {
+		t.Fatalf("provision dbs = %v", b.dbs)
+	}
+	if err := tenants.Provision("a.b", spec); err == nil {
+		t.Fatal("invalid tenant should fail")
+	}
+	b.indexErr["users"] = errors.New("boom")
+	if err := tenants.Provision("acme", spec); err == nil || !strings.Contains(err.Error(), "tenant acme index users") || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("provision err = %v", err)
+	}
+}
+
+func TestWithTenantsBackend(t *testing.T) {
+	c := &DialContext{}
+	e, _ := NewEncryptor(1, []byte("0123456789abcdef"))
+	sc := c.WithEncryptor(e)
+	cc := c.WithCache(nil, time.Minute)
+	cases := []struct {
+		tenants *Tenants
+		want    TenantBackend
+	}{
+		{c.WithTenants(PrefixResolver("t_")), c},
+		{sc.WithTenants(PrefixResolver("t_")), sc},
+		{cc.WithTenants(PrefixResolver("t_")), cc},
+	}
+	for _, cs := range cases {
+		// 租户的读写必须经过加密和缓存层，不能退回到内嵌的 DialContext
+		if cs.tenants.c != cs.want {
+			t.Errorf("backend = %T, want %T", cs.tenants.c, cs.want)
+		}
+	}
+}
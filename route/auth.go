@@ -0,0 +1,261 @@
+package route
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthMode 路由的授权方式
+type AuthMode int
+
+const (
+	// AuthInherit 继承上级分组，顶层时使用 Router 的默认方式
+	AuthInherit AuthMode = iota
+	// AuthRequired 必须授权
+	AuthRequired
+	// AuthOptional 有凭证时校验并写入 claims，没有凭证也可以访问。Role 大于 0 时等同于 AuthRequired
+	AuthOptional
+	// AuthNone 不授权，公开路由。设置了 Role、Permissions 或 Owner 时仍然需要授权
+	AuthNone
+)
+
+// ErrNoCredentials 请求中没有该方式的凭证，链式认证时交给下一个认证器
+var ErrNoCredentials = errors.New("no credentials")
+
+// Authenticator 认证器，从请求中解析用户信息包。
+// 请求中没有对应凭证时返回 ErrNoCredentials，凭证无效时返回其他错误。
+type Authenticator interface {
+	Authenticate(c *Context) (*UserClaims, error)
+}
+
+// AuthenticatorFunc 函数形式的认证器
+type AuthenticatorFunc func(c *Context) (*UserClaims, error)
+
+// Authenticate 认证
+func (f AuthenticatorFunc) Authenticate(c *Context) (*UserClaims, error) {
+	return f(c)
+}
+
+// SetAuthenticator 设置默认认证器，未设置时有密钥集合则使用 BearerAuthenticator
+func (r *Router) SetAuthenticator(a Authenticator) {
+	r.Lock()
+	r.authenticator = a
+	r.Unlock()
+}
+
+// SetDefaultAuth 设置顶层路由的默认授权方式，默认为 AuthRequired
+func (r *Router) SetDefaultAuth(mode AuthMode) {
+	r.Lock()
+	r.defaultAuth = mode
+	r.Unlock()
+}
+
+func (r *Router) getAuthenticator() Authenticator {
+	r.RLock()
+	defer r.RUnlock()
+	if r.authenticator != nil {
+		return r.authenticator
+	}
+	if r.keys != nil {
+		return BearerAuthenticator()
+	}
+	return nil
+}
+
+// ChainAuthenticators 依次尝试多个认证器，使用第一个找到凭证的认证器的结果
+func ChainAuthenticators(as ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(c *Context) (*UserClaims, error) {
+		for _, a := range as {
+			claims, err := a.Authenticate(c)
+			if err != ErrNoCredentials {
+				return claims, err
+			}
+		}
+		return nil, ErrNoCredentials
+	})
+}
+
+// BearerAuthenticator 从 Authorization 头读取 jwt，兼容不带 Bearer 前缀的写法
+func BearerAuthenticator() Authenticator {
+	return AuthenticatorFunc(func(c *Context) (*UserClaims, error) {
+		auth := strings.TrimSpace(c.GetHeader("Authorization"))
+		if auth == "" {
+			return nil, ErrNoCredentials
+		}
+		if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+			auth = strings.TrimSpace(auth[7:])
+		} else if strings.Contains(auth, " ") {
+			// 其他认证方案，交给下一个认证器
+			return nil, ErrNoCredentials
+		}
+		return c.GetRouter().VerifyToken(auth)
+	})
+}
+
+// CookieAuthenticator 从 cookie 读取 jwt
+func CookieAuthenticator(name string) Authenticator {
+	return AuthenticatorFunc(func(c *Context) (*UserClaims, error) {
+		token, err := c.Cookie(name)
+		if err != nil || token == "" {
+			return nil, ErrNoCredentials
+		}
+		return c.GetRouter().VerifyToken(token)
+	})
+}
+
+// =================== API key ======================
+
+// APIKeyAuthenticator 静态 API key 认证，只保存 key 的 sha256
+type APIKeyAuthenticator struct {
+	sync.RWMutex
+	header string
+	keys   map[string]*UserClaims
+}
+
+// NewAPIKeyAuthenticator 创建 API key 认证器，header 为空时使用 X-API-Key
+func NewAPIKeyAuthenticator(header string) *APIKeyAuthenticator {
+	if header == "" {
+		header = "X-API-Key"
+	}
+	return &APIKeyAuthenticator{
+		header: header,
+		keys:   map[string]*UserClaims{},
+	}
+}
+
+// HashAPIKey 计算 API key 的 sha256，用于配置文件中保存
+func HashAPIKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// AddKey 添加明文 API key
+func (a *APIKeyAuthenticator) AddKey(key string, claims *UserClaims) {
+	a.AddHashedKey(HashAPIKey(key), claims)
+}
+
+// AddHashedKey 添加 sha256 后的 API key
+func (a *APIKeyAuthenticator) AddHashedKey(hash string, claims *UserClaims) {
+	a.Lock()
+	a.keys[strings.ToLower(hash)] = claims
+	a.Unlock()
+}
+
+// RemoveHashedKey 删除 API key
+func (a *APIKeyAuthenticator) RemoveHashedKey(hash string) {
+	a.Lock()
+	delete(a.keys, strings.ToLower(hash))
+	a.Unlock()
+}
+
+// Authenticate 认证
+func (a *APIKeyAuthenticator) Authenticate(c *Context) (*UserClaims, error) {
+	key := c.GetHeader(a.header)
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+	a.RLock()
+	claims, ok := a.keys[HashAPIKey(key)]
+	a.RUnlock()
+	if !ok {
+		return nil, errors.New("invalid api key")
+	}
+	cc := *claims
+	return &cc, nil
+}
+
+// =================== HMAC ======================
+
+const (
+	headerKeyID     = "X-Key-Id"
+	headerTimestamp = "X-Timestamp"
+	headerSignature = "X-Signature"
+)
+
+type hmacClient struct {
+	secret []byte
+	claims *UserClaims
+}
+
+// HMACAuthenticator 请求签名认证。
+// 客户端在 X-Key-Id、X-Timestamp(unix 秒)、X-Signature 头中携带签名，签名为
+// hex(hmac-sha256(secret, METHOD + "\n" + RequestURI + "\n" + X-Timestamp + "\n" + hex(sha256(body))))
+type HMACAuthenticator struct {
+	sync.RWMutex
+	MaxSkew time.Duration // 允许的时间误差，默认 5 分钟
+	clients map[string]*hmacClient
+}
+
+// NewHMACAuthenticator 创建请求签名认证器
+func NewHMACAuthenticator() *HMACAuthenticator {
+	return &HMACAuthenticator{
+		MaxSkew: 5 * time.Minute,
+		clients: map[string]*hmacClient{},
+	}
+}
+
+// AddClient 添加客户端
+func (a *HMACAuthenticator) AddClient(keyID string, secret []byte, claims *UserClaims) {
+	a.Lock()
+	a.clients[keyID] = &hmacClient{secret, claims}
+	a.Unlock()
+}
+
+// SignRequest 计算请求签名
+func SignRequest(secret []byte, method, requestURI, timestamp string, body []byte) string {
+	bh := sha256.Sum256(body)
+	m := hmac.New(sha256.New, secret)
+	fmt.Fprintf(m, "%s\n%s\n%s\n%s", strings.ToUpper(method), requestURI, timestamp, hex.EncodeToString(bh[:]))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// Authenticate 认证
+func (a *HMACAuthenticator) Authenticate(c *Context) (*UserClaims, error) {
+	keyID := c.GetHeader(headerKeyID)
+	sig := c.GetHeader(headerSignature)
+	if keyID == "" || sig == "" {
+		return nil, ErrNoCredentials
+	}
+	a.RLock()
+	client, ok := a.clients[keyID]
+	a.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %s", keyID)
+	}
+
+	ts := c.GetHeader(headerTimestamp)
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid timestamp")
+	}
+	skew := time.Since(time.Unix(sec, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > a.MaxSkew {
+		return nil, errors.New("timestamp expired")
+	}
+
+	var body []byte
+	if c.Request.Body != nil {
+		if body, err = ioutil.ReadAll(c.Request.Body); err != nil {
+			return nil, err
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	expected := SignRequest(client.secret, c.Request.Method, c.Request.URL.RequestURI(), ts, body)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(sig))) {
+		return nil, errors.New("invalid signature")
+	}
+	cc := *client.claims
+	return &cc, nil
+}
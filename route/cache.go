@@ -0,0 +1,238 @@
+package route
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/skiplee85/common/mongodb"
+)
+
+// VaryBy 响应缓存按哪些请求信息区分。缓存键总是包含查询参数；
+// 请求带有 claims 时默认按用户区分，设置 VaryRole 后同角色的用户共享缓存
+type VaryBy int
+
+const (
+	// VaryUser 按用户区分
+	VaryUser VaryBy = 1 << iota
+	// VaryRole 按角色区分
+	VaryRole
+	// VaryQuery 按查询参数区分，已默认包含，保留用于兼容
+	VaryQuery
+)
+
+// ResponseCache 响应缓存配置，只缓存 GET 请求中业务码为 CodeOk 的 200 响应
+type ResponseCache struct {
+	TTL     time.Duration
+	VaryBy  VaryBy
+	Tags    []string                  // 缓存标签，InvalidateCache 使标签下的缓存失效
+	TagFunc func(c *Context) []string // 按请求生成的标签，如 order:{id}
+	Store   mongodb.Cache             // 默认使用 Router 的缓存
+}
+
+// cachedResponse 缓存的响应
+type cachedResponse struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"contentType"`
+	ETag        string `json:"etag"`
+	Body        []byte `json:"body"`
+}
+
+// SetResponseCache 设置默认的响应缓存，缓存标签的版本也保存在这里
+func (r *Router) SetResponseCache(cache mongodb.Cache) {
+	r.Lock()
+	r.respCache = cache
+	r.Unlock()
+}
+
+func (r *Router) getResponseCache() mongodb.Cache {
+	r.Lock()
+	defer r.Unlock()
+	if r.respCache == nil {
+		r.respCache = mongodb.NewLRUCache(0, 0)
+	}
+	return r.respCache
+}
+
+// tagVersion 标签的当前版本，缓存键中包含标签版本，失效时更新版本即可
+func (r *Router) tagVersion(tag string) string {
+	cache := r.getResponseCache()
+	if v, ok := cache.Get("tag|" + tag); ok {
+		return string(v)
+	}
+	// 版本丢失时生成新版本，不能回到空版本命中旧缓存
+	v := newTokenID()
+	cache.Set("tag|"+tag, []byte(v), 0)
+	return v
+}
+
+// InvalidateCache 使标签下的响应缓存失效
+func (r *Router) InvalidateCache(tags ...string) {
+	cache := r.getResponseCache()
+	for _, tag := range tags {
+		cache.Set("tag|"+tag, []byte(newTokenID()), 0)
+	}
+}
+
+// InvalidateCache 使标签下的响应缓存失效
+func (c *Context) InvalidateCache(tags ...string) {
+	c.GetRouter().InvalidateCache(tags...)
+}
+
+// computeETag 强 ETag
+func computeETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatch If-None-Match 是否包含 etag
+func etagMatch(ifNoneMatch string, etag string) bool {
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedWriter 缓存响应，处理完成后再写出，以便设置 ETag 或返回 304
+type bufferedWriter struct {
+	gin.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedWriter) WriteHeader(code int) {
+	if code > 0 {
+		w.status = code
+	}
+}
+
+func (w *bufferedWriter) WriteHeaderNow() {}
+
+func (w *bufferedWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+func (w *bufferedWriter) WriteString(s string) (int, error) {
+	return w.body.WriteString(s)
+}
+
+func (w *bufferedWriter) Status() int {
+	return w.status
+}
+
+func (w *bufferedWriter) Size() int {
+	return w.body.Len()
+}
+
+func (w *bufferedWriter) Written() bool {
+	return w.body.Len() > 0
+}
+
+// flush 写出缓存的响应
+func (w *bufferedWriter) flush() {
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(w.body.Bytes())
+}
+
+// cacheKey 响应缓存的键，包含路径、区分信息、协商的格式和语言以及标签版本
+func (rc *ResponseCache) cacheKey(c *Context) string {
+	parts := []string{"resp", c.Request.Method, c.Request.URL.Path, c.Request.URL.Query().Encode()}
+	claims := c.GetClaims()
+	// 授权过的请求没有明确按角色共享时按用户区分，避免把一个用户的响应下发给另一个用户
+	if rc.VaryBy&VaryUser != 0 || (rc.VaryBy&VaryRole == 0 && claims != nil) {
+		if claims != nil {
+			parts = append(parts, "u"+strconv.Itoa(claims.UserID))
+		} else {
+			parts = append(parts, "u")
+		}
+	}
+	if rc.VaryBy&VaryRole != 0 {
+		if claims != nil {
+			parts = append(parts, "r"+strconv.Itoa(claims.Role))
+		} else {
+			parts = append(parts, "r")
+		}
+	}
+	parts = append(parts,
+		c.NegotiateFormat(binding.MIMEJSON, binding.MIMEMSGPACK, binding.MIMEMSGPACK2, binding.MIMEPROTOBUF),
+		c.Locale(),
+	)
+	tags := rc.Tags
+	if rc.TagFunc != nil {
+		tags = append(append([]string{}, tags...), rc.TagFunc(c)...)
+	}
+	r := c.GetRouter()
+	for _, tag := range tags {
+		parts = append(parts, tag+"="+r.tagVersion(tag))
+	}
+	return strings.Join(parts, "|")
+}
+
+// writeCached 下发缓存的响应，If-None-Match 匹配时返回 304
+func writeCached(c *Context, resp *cachedResponse) {
+	c.Header("ETag", resp.ETag)
+	if etagMatch(c.GetHeader("If-None-Match"), resp.ETag) {
+		c.Status(http.StatusNotModified)
+		c.Writer.WriteHeaderNow()
+		return
+	}
+	c.Data(resp.Status, resp.ContentType, resp.Body)
+}
+
+// CacheMiddleware 响应缓存中间件，需要放在授权之后。可以通过 BaseRoute.Cache 配置
+func CacheMiddleware(rc *ResponseCache) gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		if gc.Request.Method != http.MethodGet && gc.Request.Method != http.MethodHead {
+			return
+		}
+		c := &Context{Context: gc}
+		store := rc.Store
+		if store == nil {
+			store = c.GetRouter().getResponseCache()
+		}
+		key := rc.cacheKey(c)
+		if data, ok := store.Get(key); ok {
+			resp := &cachedResponse{}
+			if err := json.Unmarshal(data, resp); err == nil {
+				c.Abort()
+				writeCached(c, resp)
+				return
+			}
+		}
+
+		bw := &bufferedWriter{ResponseWriter: c.Writer, status: http.StatusOK}
+		c.Writer = bw
+		func() {
+			// panic 时恢复原来的 Writer，由 recovery 下发错误
+			defer func() {
+				c.Writer = bw.ResponseWriter
+			}()
+			c.Next()
+		}()
+
+		resp := &cachedResponse{
+			Status:      bw.status,
+			ContentType: bw.Header().Get("Content-Type"),
+			ETag:        computeETag(bw.body.Bytes()),
+			Body:        bw.body.Bytes(),
+		}
+		if resp.Status == http.StatusOK && c.GetInt(keyRespCode) == CodeOk {
+			if data, err := json.Marshal(resp); err == nil {
+				store.Set(key, data, rc.TTL)
+			}
+			writeCached(c, resp)
+			return
+		}
+		bw.flush()
+	}
+}
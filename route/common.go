@@ -1,33 +1,26 @@
 package route
 
 import (
-	"log"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/rs/cors"
 )
 
 const (
 	// KeyRole 角色
 	KeyRole       = "keyRole"
 	keyUserClaims = "keyUserClaims"
-)
-
-var (
-	errMsg = map[int]string{
-		CodeOk:                    "success",
-		CodeErrorRequest:          "error request",
-		CodeErrorInternal:         "server error.",
-		CodeErrorInvalidArguments: "invalid arguments.",
-	}
-	jwtSecret = ""
+	keyRouter     = "keyRouter"
 )
 
 // Context gin.Context 二次封装
 type Context struct {
 	*gin.Context
+	router *Router
 }
 
 // BaseRoute 路由表
@@ -38,82 +31,53 @@ type BaseRoute struct {
 	Middlewares []gin.HandlerFunc
 	Role        int // 访问所需的最小角色，高级角色拥有低级角色的权限。0 表示没要求，未授权的用户也可以访问。
 	Child       []*BaseRoute
+
+	Permissions    []string       // 访问所需的权限，如 orders:write。分组上的权限对所有子路由生效
+	PermissionMode PermissionMode // Permissions 的匹配方式，默认需要全部权限
+	Owner          OwnerFunc      // 资源所有者检查
+
+	Auth          AuthMode       // 授权方式，默认继承上级分组
+	Authenticator Authenticator  // 认证器，默认继承上级分组或使用 Router 的认证器
+	CORS          *CORSOptions   // 跨域配置，覆盖 Router 的配置，对分组下所有路由生效
+	RateLimit     *RateLimit     // 限流，设置在分组上时分组下所有路由共享令牌桶
+	Doc           *RouteDoc      // 接口文档
+	Cache         *ResponseCache // 响应缓存，设置在分组上时对分组下的 GET 路由生效
+	Timeout       time.Duration  // 处理超时，见 WithTimeout，默认继承上级分组
 }
 
-// InitErrorMsg 初始化自定义错误码
+// InitErrorMsg 初始化默认路由的自定义错误码
 func InitErrorMsg(msgMap map[int]string) {
-	for no, msg := range msgMap {
-		errMsg[no] = msg
-	}
+	defaultRouter.InitErrorMsg(msgMap)
 }
 
-// GetRouteHandler 获取路由
+// GetRouteHandler 使用默认路由获取 http.Handler
 func GetRouteHandler(routeConf []*BaseRoute, jwtToken string, isDebug bool) http.Handler {
-	jwtSecret = jwtToken
-	if !isDebug {
-		gin.SetMode(gin.ReleaseMode)
-	}
-	defaultRoute := gin.Default()
-	for _, r := range routeConf {
-		createRouteHandler(r, &defaultRoute.RouterGroup, 0, nil)
-	}
-
-	// 跨域请求
-	c := cors.New(cors.Options{
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "*"},
-		AllowedHeaders:   []string{"Authorization", "*"},
-		AllowCredentials: true,
-		Debug:            false,
-	})
-
-	return c.Handler(defaultRoute)
+	defaultRouter.SetJwtSecret(jwtToken)
+	return defaultRouter.Handler(routeConf, isDebug)
 }
 
-func createRouteHandler(rConf *BaseRoute, g *gin.RouterGroup, role int, hf []gin.HandlerFunc) {
-	r := *rConf
-	if r.Role > 0 {
-		role = r.Role
-	}
-	if len(r.Middlewares) > 0 {
-		if hf == nil {
-			hf = []gin.HandlerFunc{}
-		}
-		hf = append(hf, r.Middlewares...)
-	}
-	// group
-	if len(r.Child) > 0 {
-		gg := g.Group(r.Path)
-		for _, rr := range r.Child {
-			createRouteHandler(rr, gg, role, hf)
-		}
-	} else {
-		hs := []gin.HandlerFunc{}
-		h := func(c *gin.Context) {
-			r.Handler(&Context{Context: c})
-		}
-		if role > 0 {
-			hs = append(hs, getRoleMiddleware(role))
-		}
-		if jwtSecret != "" {
-			hs = append(hs, authMiddleware)
-		}
-		if len(hf) > 0 {
-			hs = append(hs, hf...)
-		}
-		hs = append(hs, h)
-		// 自定义中间件
-		if len(r.Middlewares) > 0 {
-			hs = append(hs, r.Middlewares...)
-		}
-		g.Handle(r.Method, r.Path, hs...)
+// GetRouter 获取处理当前请求的路由
+func (c *Context) GetRouter() *Router {
+	if c.router == nil {
+		c.router = getRouter(c.Context)
 	}
+	return c.router
 }
 
-// ValidaArgs 检查参数
+// ValidaArgs 检查参数，请求体支持 JSON、MessagePack 和 Protobuf
 func (c *Context) ValidaArgs(args interface{}) error {
-	if err := c.ShouldBind(args); err != nil {
-		log.Printf("invalid args. %v. url=%s", err.Error(), c.Request.URL.String())
-		c.AbortWithStatusJSON(http.StatusOK, &BaseResponse{Code: CodeErrorInvalidArguments, Msg: err.Error()})
+	if err := c.bindArgs(args); err != nil {
+		c.Logger().Printf("invalid args. %v. url=%s", err.Error(), c.Request.URL.String())
+		fes := c.FieldErrors(err)
+		detail := err.Error()
+		if len(fes) > 0 {
+			detail = fes[0].Message
+		}
+		m, ok := c.Message(strconv.Itoa(CodeErrorInvalidArguments), Params{"error": detail})
+		if !ok {
+			m = detail
+		}
+		c.abortResponse(http.StatusOK, &BaseResponse{Code: CodeErrorInvalidArguments, Msg: m, Errors: fes})
 		return err
 	}
 	return nil
@@ -121,30 +85,44 @@ func (c *Context) ValidaArgs(args interface{}) error {
 
 // SendError 下发错误
 func (c *Context) SendError(code int, msgs ...string) {
-	httpStatus := http.StatusInternalServerError
-	if code >= 1000 {
-		httpStatus = http.StatusBadRequest
-	}
-	m := errMsg[code]
+	httpStatus := c.GetRouter().GetErrorStatus(code)
+	m := c.ErrorMsg(code, nil)
 	if len(msgs) > 0 {
 		m = msgs[0]
 	}
-	c.AbortWithStatusJSON(httpStatus, &BaseResponse{
+	c.abortResponse(httpStatus, &BaseResponse{
 		Code: code,
 		Msg:  m,
 	})
 }
 
+// writeResponse 下发 BaseResponse，status 为原有的状态码，实际状态码由 Router 的 ResponsePolicy 决定
+func (c *Context) writeResponse(status int, resp *BaseResponse) {
+	c.respond(status, false, resp)
+}
+
+// respond 下发 BaseResponse，记录业务码
+func (c *Context) respond(status int, fixed bool, resp *BaseResponse) {
+	c.Set(keyRespCode, resp.Code)
+	c.render(c.GetRouter().responseStatus(status, resp.Code, fixed), resp)
+}
+
+// abortResponse 中止后续处理并下发 BaseResponse
+func (c *Context) abortResponse(status int, resp *BaseResponse) {
+	c.Abort()
+	c.writeResponse(status, resp)
+}
+
 // Send 下发消息
 func (c *Context) Send(data interface{}) {
-	c.JSON(http.StatusOK, &BaseResponse{
+	c.writeResponse(http.StatusOK, &BaseResponse{
 		Data: data,
 	})
 }
 
 // SendWithPagination 带翻页信息
 func (c *Context) SendWithPagination(data interface{}, p *Pagination) {
-	c.JSON(http.StatusOK, &BaseResponse{
+	c.writeResponse(http.StatusOK, &BaseResponse{
 		Data:       data,
 		Pagination: p,
 	})
@@ -159,8 +137,11 @@ func (c *Context) GetClaims() *UserClaims {
 	return v.(*UserClaims)
 }
 
-// GetIP 获取IP
+// GetIP 获取IP。Router 设置了可信代理时按可信代理解析，否则信任请求中的转发头。
 func GetIP(c *gin.Context) string {
+	if resolver := getRouter(c).getIPResolver(); resolver != nil {
+		return resolver.ClientIP(c.Request)
+	}
 	ip := ""
 	findHeader := []string{
 		"X-Real-IP",
@@ -177,12 +158,22 @@ func GetIP(c *gin.Context) string {
 			break
 		}
 	}
+	// X-Forwarded-For 为逗号分隔的列表，第一个为客户端
+	if i := strings.Index(ip, ","); i >= 0 {
+		ip = ip[:i]
+	}
+	ip = strings.TrimSpace(ip)
 	if ip == "" {
 		ip, _, _ = net.SplitHostPort(c.Request.RemoteAddr)
 	}
 	return ip
 }
 
+// GetIP 获取IP
+func (c *Context) GetIP() string {
+	return GetIP(c.Context)
+}
+
 // Finish 完成请求
 func (c *Context) Finish(data interface{}, eno int) {
 	if eno != CodeOk {
@@ -191,3 +182,11 @@ func (c *Context) Finish(data interface{}, eno int) {
 	}
 	c.Send(data)
 }
+
+// GetTenantID 获取当前用户的租户ID
+func (c *Context) GetTenantID() string {
+	if claims := c.GetClaims(); claims != nil {
+		return claims.TenantID
+	}
+	return ""
+}
@@ -0,0 +1,112 @@
+package route
+
+import (
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/rs/cors"
+)
+
+// CORSOptions 跨域配置
+type CORSOptions struct {
+	AllowedOrigins   []string // 允许的来源，支持 https://*.example.com 通配子域名，为空时允许所有来源
+	AllowedMethods   []string // 允许的方法
+	AllowedHeaders   []string // 允许的请求头，* 表示所有
+	ExposedHeaders   []string // 允许前端读取的响应头
+	MaxAge           int      // 预检请求缓存时间(秒)
+	AllowCredentials bool     // 是否允许携带 cookie，应与 AllowedOrigins 一起使用
+}
+
+// DefaultCORSOptions 默认跨域配置，允许所有来源。
+// 注意：默认不再允许携带 cookie，任意来源加上 AllowCredentials 会让任何网站带着用户的 cookie 调用接口，
+// 需要 cookie 时请同时配置 AllowedOrigins 和 AllowCredentials
+func DefaultCORSOptions() *CORSOptions {
+	return &CORSOptions{
+		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "*"},
+		AllowedHeaders: []string{"Authorization", "*"},
+	}
+}
+
+func (o *CORSOptions) newCors() *cors.Cors {
+	return cors.New(cors.Options{
+		AllowedOrigins:   o.AllowedOrigins,
+		AllowedMethods:   o.AllowedMethods,
+		AllowedHeaders:   o.AllowedHeaders,
+		ExposedHeaders:   o.ExposedHeaders,
+		MaxAge:           o.MaxAge,
+		AllowCredentials: o.AllowCredentials,
+	})
+}
+
+// corsPolicy 某个分组或路由的跨域配置
+type corsPolicy struct {
+	segments []string
+	exact    bool // 路由只匹配自身路径，分组匹配路径前缀
+	handler  http.Handler
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// match 按路由规则匹配路径，:name 匹配一段，*name 匹配剩余部分
+func (p *corsPolicy) match(segments []string) bool {
+	for i, s := range p.segments {
+		if strings.HasPrefix(s, "*") {
+			return true
+		}
+		if i >= len(segments) {
+			return false
+		}
+		if s != segments[i] && !strings.HasPrefix(s, ":") {
+			return false
+		}
+	}
+	return !p.exact || len(segments) == len(p.segments)
+}
+
+// corsHandler 按请求路径选择跨域配置，越具体的配置优先
+type corsHandler struct {
+	policies []*corsPolicy
+	def      http.Handler
+	next     http.Handler
+}
+
+func newCORSHandler(def *CORSOptions, next http.Handler) *corsHandler {
+	return &corsHandler{
+		def:  def.newCors().Handler(next),
+		next: next,
+	}
+}
+
+func (h *corsHandler) add(fullPath string, exact bool, opts *CORSOptions) {
+	h.policies = append(h.policies, &corsPolicy{
+		segments: splitPath(path.Clean("/" + fullPath)),
+		exact:    exact,
+		handler:  opts.newCors().Handler(h.next),
+	})
+	sort.SliceStable(h.policies, func(i, j int) bool {
+		pi, pj := h.policies[i], h.policies[j]
+		if len(pi.segments) != len(pj.segments) {
+			return len(pi.segments) > len(pj.segments)
+		}
+		return pi.exact && !pj.exact
+	})
+}
+
+func (h *corsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	segments := splitPath(req.URL.Path)
+	for _, p := range h.policies {
+		if p.match(segments) {
+			p.handler.ServeHTTP(w, req)
+			return
+		}
+	}
+	h.def.ServeHTTP(w, req)
+}
@@ -0,0 +1,85 @@
+package route
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/gin-gonic/gin/render"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// render 按 Accept 协商格式下发 BaseResponse，默认为 JSON。
+// Protobuf 使用 google.protobuf.Struct 作为通用信封，字段与 JSON 一致
+func (c *Context) render(status int, resp *BaseResponse) {
+	switch c.NegotiateFormat(binding.MIMEJSON, binding.MIMEMSGPACK, binding.MIMEMSGPACK2, binding.MIMEPROTOBUF) {
+	case binding.MIMEMSGPACK, binding.MIMEMSGPACK2:
+		c.Render(status, render.MsgPack{Data: resp})
+	case binding.MIMEPROTOBUF:
+		st, err := toStruct(resp)
+		if err != nil {
+			c.Logger().Printf("encode protobuf envelope fail. %v", err)
+			c.JSON(status, resp)
+			return
+		}
+		c.ProtoBuf(status, st)
+	default:
+		c.JSON(status, resp)
+	}
+}
+
+// toStruct 通过 JSON 转为 google.protobuf.Struct
+func toStruct(v interface{}) (*structpb.Struct, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	st := &structpb.Struct{}
+	return st, protojson.Unmarshal(data, st)
+}
+
+// bindArgs 绑定请求参数。Protobuf 请求的参数不是 proto.Message 时按 google.protobuf.Struct 信封解析
+func (c *Context) bindArgs(args interface{}) error {
+	if c.Request.Method != http.MethodGet && c.ContentType() == binding.MIMEPROTOBUF {
+		if _, ok := args.(proto.Message); !ok {
+			return c.ShouldBindWith(args, protobufEnvelope{})
+		}
+	}
+	return c.ShouldBind(args)
+}
+
+// protobufEnvelope google.protobuf.Struct 信封的参数绑定
+type protobufEnvelope struct{}
+
+func (protobufEnvelope) Name() string {
+	return "protobuf-envelope"
+}
+
+func (b protobufEnvelope) Bind(req *http.Request, obj interface{}) error {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	return b.BindBody(body, obj)
+}
+
+func (protobufEnvelope) BindBody(body []byte, obj interface{}) error {
+	st := &structpb.Struct{}
+	if err := proto.Unmarshal(body, st); err != nil {
+		return err
+	}
+	data, err := protojson.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, obj); err != nil {
+		return err
+	}
+	if binding.Validator == nil {
+		return nil
+	}
+	return binding.Validator.ValidateStruct(obj)
+}
@@ -0,0 +1,218 @@
+package route
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrorCoder 带错误码的错误，SendErr 下发对应的错误码
+type ErrorCoder interface {
+	error
+	ErrorCode() int
+}
+
+// APIError 接口错误。Cause 只记录在服务端日志中，不会下发给客户端
+type APIError struct {
+	Code    int         // 业务码
+	Message string      // 为空时使用错误码对应的信息
+	Status  int         // HTTP 状态码，为 0 时按 Router 的错误码状态映射
+	Details interface{} // 下发给客户端的附加信息
+	Params  Params      // 信息模板参数
+	Cause   error       // 原始错误
+}
+
+// NewError 创建接口错误，msgs 为空时使用错误码对应的信息
+func NewError(code int, msgs ...string) *APIError {
+	e := &APIError{Code: code}
+	if len(msgs) > 0 {
+		e.Message = msgs[0]
+	}
+	return e
+}
+
+// WrapError 使用错误码包装原始错误
+func WrapError(err error, code int, msgs ...string) *APIError {
+	e := NewError(code, msgs...)
+	e.Cause = err
+	return e
+}
+
+// Error 实现 error
+func (e *APIError) Error() string {
+	s := fmt.Sprintf("api error %d", e.Code)
+	if e.Message != "" {
+		s += ": " + e.Message
+	}
+	if e.Cause != nil {
+		s += ": " + e.Cause.Error()
+	}
+	return s
+}
+
+// ErrorCode 实现 ErrorCoder
+func (e *APIError) ErrorCode() int {
+	return e.Code
+}
+
+// Unwrap 支持 errors.Is/As 匹配原始错误
+func (e *APIError) Unwrap() error {
+	return e.Cause
+}
+
+// Is 错误码相同的 APIError 视为同一错误，可以用 errors.Is(err, ErrXXX) 判断
+func (e *APIError) Is(target error) bool {
+	t, ok := target.(*APIError)
+	return ok && t.Code == e.Code
+}
+
+// WithCause 返回带原始错误的副本，不修改 e
+func (e *APIError) WithCause(err error) *APIError {
+	c := *e
+	c.Cause = err
+	return &c
+}
+
+// WithStatus 返回指定 HTTP 状态码的副本，不修改 e
+func (e *APIError) WithStatus(status int) *APIError {
+	c := *e
+	c.Status = status
+	return &c
+}
+
+// WithDetails 返回带附加信息的副本，不修改 e
+func (e *APIError) WithDetails(details interface{}) *APIError {
+	c := *e
+	c.Details = details
+	return &c
+}
+
+// WithParams 返回带信息模板参数的副本，不修改 e
+func (e *APIError) WithParams(params Params) *APIError {
+	c := *e
+	c.Params = params
+	return &c
+}
+
+// StatusRange 错误码区间 [Min, Max] 对应的 HTTP 状态码
+type StatusRange struct {
+	Min    int
+	Max    int
+	Status int
+}
+
+// SetErrorStatus 设置错误码到 HTTP 状态码的映射，按顺序匹配第一个区间。
+// 没有匹配的区间时，错误码 >= 1000 为 400，其他为 500
+func (r *Router) SetErrorStatus(ranges ...StatusRange) {
+	r.Lock()
+	r.errStatus = ranges
+	r.Unlock()
+}
+
+func (r *Router) matchErrorStatus(code int) (int, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	for _, sr := range r.errStatus {
+		if code >= sr.Min && code <= sr.Max {
+			return sr.Status, true
+		}
+	}
+	return 0, false
+}
+
+// GetErrorStatus 获取错误码对应的 HTTP 状态码
+func (r *Router) GetErrorStatus(code int) int {
+	if s, ok := r.matchErrorStatus(code); ok {
+		return s
+	}
+	if code >= 1000 {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// isServerError 业务码是否表示服务端错误，与响应策略无关
+func (r *Router) isServerError(code int) bool {
+	if s, ok := r.matchErrorStatus(code); ok {
+		return s >= http.StatusInternalServerError
+	}
+	return code >= 500 && code < 600
+}
+
+// ResponsePolicy 下发 BaseResponse 时 HTTP 状态码的策略
+type ResponsePolicy int
+
+const (
+	// PolicyLegacy 保持各处原有的状态码，默认策略
+	PolicyLegacy ResponsePolicy = iota
+	// PolicyAlwaysOK 总是返回 200，客户端只通过业务码判断结果
+	PolicyAlwaysOK
+	// PolicyRESTful 按业务码返回 HTTP 状态码。成功为 200，SetErrorStatus 的区间优先，
+	// 400-599 的业务码直接作为状态码，其他按 GetErrorStatus
+	PolicyRESTful
+)
+
+// SetResponsePolicy 设置 HTTP 状态码策略，对所有下发 BaseResponse 的地方生效
+func (r *Router) SetResponsePolicy(p ResponsePolicy) {
+	r.Lock()
+	r.respPolicy = p
+	r.Unlock()
+}
+
+// responseStatus 按策略获取下发的 HTTP 状态码，fixed 为调用方明确指定的状态码
+func (r *Router) responseStatus(status int, code int, fixed bool) int {
+	r.RLock()
+	policy := r.respPolicy
+	r.RUnlock()
+	switch policy {
+	case PolicyAlwaysOK:
+		return http.StatusOK
+	case PolicyRESTful:
+		if fixed {
+			return status
+		}
+		if code == CodeOk {
+			return http.StatusOK
+		}
+		if s, ok := r.matchErrorStatus(code); ok {
+			return s
+		}
+		if code >= 400 && code < 600 {
+			return code
+		}
+		return r.GetErrorStatus(code)
+	}
+	return status
+}
+
+// SendErr 下发 error。APIError 按其字段下发，ErrorCoder 下发对应的错误码，
+// 其他错误下发 CodeErrorInternal。原始错误只记录在日志中
+func (c *Context) SendErr(err error) {
+	var ae *APIError
+	if !errors.As(err, &ae) {
+		var coder ErrorCoder
+		if errors.As(err, &coder) {
+			ae = NewError(coder.ErrorCode())
+		} else {
+			ae = NewError(CodeErrorInternal)
+		}
+		ae.Cause = err
+	}
+	if ae.Cause != nil {
+		c.Logger().Printf("handler error. %s %s %v", c.Request.Method, c.Request.URL, err)
+	}
+	status := ae.Status
+	if status == 0 {
+		status = c.GetRouter().GetErrorStatus(ae.Code)
+	}
+	m := formatMessage(ae.Message, ae.Params)
+	if m == "" {
+		m = c.ErrorMsg(ae.Code, ae.Params)
+	}
+	c.Abort()
+	c.respond(status, ae.Status != 0, &BaseResponse{
+		Code:    ae.Code,
+		Msg:     m,
+		Details: ae.Details,
+	})
+}
@@ -0,0 +1,259 @@
+package route
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Params 信息模板参数，模板中使用 {name} 引用
+type Params map[string]interface{}
+
+// Catalog 多语言信息表，locale -> key -> 信息模板。
+// 错误码的 key 为错误码的十进制字符串，如 "1000"
+type Catalog struct {
+	sync.RWMutex
+	fallback string
+	msgs     map[string]map[string]string
+}
+
+// NewCatalog 创建信息表，fallback 为协商不到语言时使用的语言
+func NewCatalog(fallback string) *Catalog {
+	return &Catalog{
+		fallback: normalizeLocale(fallback),
+		msgs:     map[string]map[string]string{},
+	}
+}
+
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(locale), "_", "-", -1))
+}
+
+// Add 添加信息，已有的 key 会被覆盖
+func (c *Catalog) Add(locale string, msgs map[string]string) {
+	locale = normalizeLocale(locale)
+	c.Lock()
+	defer c.Unlock()
+	m, ok := c.msgs[locale]
+	if !ok {
+		m = map[string]string{}
+		c.msgs[locale] = m
+	}
+	for k, v := range msgs {
+		m[k] = v
+	}
+}
+
+// AddCodes 添加错误码信息
+func (c *Catalog) AddCodes(locale string, msgs map[int]string) {
+	m := make(map[string]string, len(msgs))
+	for code, msg := range msgs {
+		m[strconv.Itoa(code)] = msg
+	}
+	c.Add(locale, m)
+}
+
+// LoadFile 从 JSON 或 YAML 文件加载信息，文件内容为 key: 信息 的映射。
+// locale 为空时使用文件名，如 zh-CN.yaml
+func (c *Catalog) LoadFile(locale string, file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	ext := filepath.Ext(file)
+	if locale == "" {
+		locale = strings.TrimSuffix(filepath.Base(file), ext)
+	}
+	msgs := map[string]string{}
+	switch strings.ToLower(ext) {
+	case ".json":
+		err = json.Unmarshal(data, &msgs)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &msgs)
+	default:
+		err = fmt.Errorf("unsupported catalog file %s", file)
+	}
+	if err != nil {
+		return err
+	}
+	c.Add(locale, msgs)
+	return nil
+}
+
+// LoadDir 加载目录下所有 JSON 和 YAML 文件，文件名为语言
+func (c *Catalog) LoadDir(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		switch strings.ToLower(filepath.Ext(f.Name())) {
+		case ".json", ".yaml", ".yml":
+			if err := c.LoadFile("", filepath.Join(dir, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Locales 已加载的语言
+func (c *Catalog) Locales() []string {
+	c.RLock()
+	defer c.RUnlock()
+	ls := make([]string, 0, len(c.msgs))
+	for l := range c.msgs {
+		ls = append(ls, l)
+	}
+	sort.Strings(ls)
+	return ls
+}
+
+// Match 在已加载的语言中匹配 locale，先完全匹配，再按主语言匹配，如 zh-TW 匹配 zh 或 zh-CN
+func (c *Catalog) Match(locale string) (string, bool) {
+	locale = normalizeLocale(locale)
+	if locale == "" {
+		return "", false
+	}
+	c.RLock()
+	defer c.RUnlock()
+	if _, ok := c.msgs[locale]; ok {
+		return locale, true
+	}
+	base := strings.SplitN(locale, "-", 2)[0]
+	if _, ok := c.msgs[base]; ok {
+		return base, true
+	}
+	match := ""
+	for l := range c.msgs {
+		if strings.HasPrefix(l, base+"-") && (match == "" || l < match) {
+			match = l
+		}
+	}
+	return match, match != ""
+}
+
+// Negotiate 按 Accept-Language 协商语言，协商不到时返回 fallback
+func (c *Catalog) Negotiate(acceptLanguage string) string {
+	for _, l := range parseAcceptLanguage(acceptLanguage) {
+		if l == "*" {
+			break
+		}
+		if m, ok := c.Match(l); ok {
+			return m
+		}
+	}
+	return c.fallback
+}
+
+// Message 获取信息并填充参数，locale 没有该 key 时使用 fallback 语言
+func (c *Catalog) Message(locale string, key string, params Params) (string, bool) {
+	c.RLock()
+	msg, ok := c.msgs[normalizeLocale(locale)][key]
+	if !ok {
+		msg, ok = c.msgs[c.fallback][key]
+	}
+	c.RUnlock()
+	if !ok {
+		return "", false
+	}
+	return formatMessage(msg, params), true
+}
+
+// formatMessage 使用参数替换模板中的 {name}
+func formatMessage(msg string, params Params) string {
+	if len(params) == 0 || !strings.Contains(msg, "{") {
+		return msg
+	}
+	kv := make([]string, 0, len(params)*2)
+	for k, v := range params {
+		kv = append(kv, "{"+k+"}", fmt.Sprint(v))
+	}
+	return strings.NewReplacer(kv...).Replace(msg)
+}
+
+// parseAcceptLanguage 解析 Accept-Language，按权重从高到低返回语言
+func parseAcceptLanguage(s string) []string {
+	type lang struct {
+		tag string
+		q   float64
+	}
+	var ls []lang
+	for _, part := range strings.Split(s, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			ls = append(ls, lang{tag, q})
+		}
+	}
+	sort.SliceStable(ls, func(i, j int) bool { return ls[i].q > ls[j].q })
+	tags := make([]string, len(ls))
+	for i, l := range ls {
+		tags[i] = l.tag
+	}
+	return tags
+}
+
+// SetCatalog 设置多语言信息表，为 nil 时只使用 InitErrorMsg 设置的信息
+func (r *Router) SetCatalog(c *Catalog) {
+	r.Lock()
+	r.catalog = c
+	r.Unlock()
+}
+
+// GetCatalog 获取多语言信息表
+func (r *Router) GetCatalog() *Catalog {
+	r.RLock()
+	defer r.RUnlock()
+	return r.catalog
+}
+
+// Locale 当前请求的语言。优先使用 token 中的 Locale，其次按 Accept-Language 协商
+func (c *Context) Locale() string {
+	catalog := c.GetRouter().GetCatalog()
+	if catalog == nil {
+		return ""
+	}
+	if claims := c.GetClaims(); claims != nil && claims.Locale != "" {
+		if l, ok := catalog.Match(claims.Locale); ok {
+			return l
+		}
+	}
+	return catalog.Negotiate(c.GetHeader("Accept-Language"))
+}
+
+// Message 获取当前语言的信息，没有时返回 false
+func (c *Context) Message(key string, params Params) (string, bool) {
+	catalog := c.GetRouter().GetCatalog()
+	if catalog == nil {
+		return "", false
+	}
+	return catalog.Message(c.Locale(), key, params)
+}
+
+// ErrorMsg 获取当前语言的错误码信息，信息表中没有时使用 InitErrorMsg 设置的信息
+func (c *Context) ErrorMsg(code int, params Params) string {
+	if m, ok := c.Message(strconv.Itoa(code), params); ok {
+		return m
+	}
+	return formatMessage(c.GetRouter().GetErrorMsg(code), params)
+}
@@ -0,0 +1,377 @@
+package route
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skiplee85/common/mongodb"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// HeaderIdempotencyKey 幂等键请求头
+	HeaderIdempotencyKey = "Idempotency-Key"
+	// HeaderIdempotentReplayed 重放的响应带有该响应头
+	HeaderIdempotentReplayed = "Idempotent-Replayed"
+)
+
+// IdempotentResponse 保存的首次响应
+type IdempotentResponse struct {
+	Status      int    `bson:"status"`
+	ContentType string `bson:"contentType"`
+	Body        []byte `bson:"body"`
+	BodyHash    string `bson:"bodyHash"` // 首次请求体的 sha256，重试的请求体不同时拒绝
+}
+
+// IdempotencyStore 幂等键存储
+type IdempotencyStore interface {
+	// Begin 占用 key，lock 为占用的超时时间。
+	// 占用成功返回 true；key 已完成时返回保存的响应；正在处理中时返回 false 和 nil
+	Begin(key string, lock time.Duration) (bool, *IdempotentResponse, error)
+	// Complete 保存响应，ttl 内的重试都重放该响应
+	Complete(key string, resp *IdempotentResponse, ttl time.Duration) error
+	// Release 释放 key，允许重试重新处理
+	Release(key string) error
+}
+
+// Idempotency 幂等配置
+type Idempotency struct {
+	TTL         time.Duration    // 响应保存时间，默认 24 小时
+	LockTimeout time.Duration    // 处理中占用的超时时间，默认 1 分钟，应大于处理函数的最长运行时间
+	Required    bool             // 缺少 Idempotency-Key 时拒绝请求
+	FailOpen    bool             // 存储出错时放行请求，默认返回 503
+	Store       IdempotencyStore // 默认使用 Router 的存储
+}
+
+// SetIdempotencyStore 设置默认的幂等键存储，多实例部署时使用 MongoIdempotencyStore
+func (r *Router) SetIdempotencyStore(s IdempotencyStore) {
+	r.Lock()
+	r.idempotencyStore = s
+	r.Unlock()
+}
+
+func (r *Router) getIdempotencyStore() IdempotencyStore {
+	r.Lock()
+	defer r.Unlock()
+	if r.idempotencyStore == nil {
+		r.idempotencyStore = NewMemoryIdempotencyStore()
+	}
+	return r.idempotencyStore
+}
+
+// responseRecorder 记录写出的响应体
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// IdempotencyMiddleware 幂等中间件，需要放在授权之后，通过 BaseRoute.Middlewares 添加。
+// 相同用户和 Idempotency-Key 的重试会重放首次响应，首次请求处理中时返回 409。
+// 相同 Idempotency-Key 但请求体不同的重试返回 422。
+// 首次请求的业务码或 HTTP 状态码表示服务端错误(5xx)时不保存，允许重试，
+// 因此 PolicyAlwaysOK 下的 CodeErrorInternal 同样不会被重放。存储出错时返回 503，除非设置了 FailOpen
+func IdempotencyMiddleware(opts *Idempotency) gin.HandlerFunc {
+	ttl := opts.TTL
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+	lock := opts.LockTimeout
+	if lock <= 0 {
+		lock = time.Minute
+	}
+	return func(gc *gin.Context) {
+		c := &Context{Context: gc}
+		ik := c.GetHeader(HeaderIdempotencyKey)
+		if ik == "" {
+			if opts.Required {
+				c.abortResponse(http.StatusBadRequest, &BaseResponse{
+					Code: CodeErrorRequest,
+					Msg:  "missing " + HeaderIdempotencyKey,
+				})
+			}
+			return
+		}
+		user := "ip:" + c.GetIP()
+		if claims := c.GetClaims(); claims != nil {
+			user = "user:" + strconv.Itoa(claims.UserID)
+		}
+		key := c.Request.Method + " " + c.FullPath() + "|" + user + "|" + ik
+		hash, err := hashBody(c.Request)
+		if err != nil {
+			c.abortResponse(http.StatusBadRequest, &BaseResponse{
+				Code: CodeErrorRequest,
+				Msg:  c.ErrorMsg(CodeErrorRequest, nil),
+			})
+			return
+		}
+
+		store := opts.Store
+		if store == nil {
+			store = c.GetRouter().getIdempotencyStore()
+		}
+		ok, saved, err := store.Begin(key, lock)
+		if err != nil {
+			c.Logger().Printf("idempotency store error. %s %v", key, err)
+			if !opts.FailOpen {
+				c.abortResponse(http.StatusServiceUnavailable, &BaseResponse{
+					Code: CodeErrorUnavailable,
+					Msg:  c.ErrorMsg(CodeErrorUnavailable, nil),
+				})
+			}
+			return
+		}
+		if saved != nil {
+			if saved.BodyHash != hash {
+				c.abortResponse(http.StatusUnprocessableEntity, &BaseResponse{
+					Code: CodeErrorRequest,
+					Msg:  HeaderIdempotencyKey + " reused with a different request body",
+				})
+				return
+			}
+			c.Abort()
+			c.Header(HeaderIdempotentReplayed, "true")
+			c.Data(saved.Status, saved.ContentType, saved.Body)
+			return
+		}
+		if !ok {
+			c.abortResponse(http.StatusConflict, &BaseResponse{
+				Code: CodeErrorConflict,
+				Msg:  c.ErrorMsg(CodeErrorConflict, nil),
+			})
+			return
+		}
+
+		// finish 保存响应，失败或 panic(result 为 nil) 时释放 key。
+		// 可能在请求结束后调用，不能再使用 c
+		logger := c.Logger()
+		router := c.GetRouter()
+		finish := func(result *handlerResult) {
+			var err error
+			if result == nil || result.Status >= http.StatusInternalServerError || router.isServerError(result.Code) {
+				err = store.Release(key)
+			} else {
+				err = store.Complete(key, &IdempotentResponse{
+					Status:      result.Status,
+					ContentType: result.ContentType,
+					Body:        result.Body,
+					BodyHash:    hash,
+				}, ttl)
+			}
+			if err != nil {
+				logger.Printf("idempotency store error. %s %v", key, err)
+			}
+		}
+
+		rw := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = rw
+		defer func() {
+			c.Writer = rw.ResponseWriter
+			if p := recover(); p != nil {
+				store.Release(key)
+				panic(newHandlerPanic(p))
+			}
+			if late := c.getLateHandler(); late != nil {
+				// 超时后处理函数仍在运行，结束前一直占用 key，重试返回 409
+				go func() {
+					finish(late.wait())
+				}()
+				return
+			}
+			finish(&handlerResult{
+				Status:      rw.Status(),
+				Code:        c.GetInt(keyRespCode),
+				ContentType: rw.Header().Get("Content-Type"),
+				Body:        rw.body.Bytes(),
+			})
+		}()
+		c.Next()
+	}
+}
+
+// hashBody 计算请求体的 sha256，并重置请求体供后续读取
+func hashBody(req *http.Request) (string, error) {
+	h := sha256.New()
+	if req.Body == nil || req.Body == http.NoBody {
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// =================== memory ======================
+
+type idempotencyEntry struct {
+	resp     *IdempotentResponse
+	expireAt time.Time
+}
+
+// MemoryIdempotencyStore 进程内幂等键存储，只适合单实例部署
+type MemoryIdempotencyStore struct {
+	sync.Mutex
+	entries map[string]*idempotencyEntry
+	sweepAt time.Time
+}
+
+// NewMemoryIdempotencyStore 创建进程内幂等键存储
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		entries: map[string]*idempotencyEntry{},
+	}
+}
+
+// Begin 占用 key
+func (s *MemoryIdempotencyStore) Begin(key string, lock time.Duration) (bool, *IdempotentResponse, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	// 定期清理过期的 key
+	if now.After(s.sweepAt) {
+		for k, e := range s.entries {
+			if now.After(e.expireAt) {
+				delete(s.entries, k)
+			}
+		}
+		s.sweepAt = now.Add(time.Minute)
+	}
+
+	if e, ok := s.entries[key]; ok && now.Before(e.expireAt) {
+		return false, e.resp, nil
+	}
+	s.entries[key] = &idempotencyEntry{expireAt: now.Add(lock)}
+	return true, nil, nil
+}
+
+// Complete 保存响应
+func (s *MemoryIdempotencyStore) Complete(key string, resp *IdempotentResponse, ttl time.Duration) error {
+	s.Lock()
+	s.entries[key] = &idempotencyEntry{resp: resp, expireAt: time.Now().Add(ttl)}
+	s.Unlock()
+	return nil
+}
+
+// Release 释放 key
+func (s *MemoryIdempotencyStore) Release(key string) error {
+	s.Lock()
+	delete(s.entries, key)
+	s.Unlock()
+	return nil
+}
+
+// =================== mongo ======================
+
+type idempotencyDoc struct {
+	ID       string              `bson:"_id"`
+	Resp     *IdempotentResponse `bson:"resp,omitempty"`
+	ExpireAt time.Time           `bson:"expireAt"`
+}
+
+// MongoIdempotencyStore 基于 mongo 的幂等键存储，多实例共享
+type MongoIdempotencyStore struct {
+	c          *mongodb.DialContext
+	db         string
+	collection string
+}
+
+// NewMongoIdempotencyStore 创建 mongo 幂等键存储
+func NewMongoIdempotencyStore(c *mongodb.DialContext, db string, collection string) (*MongoIdempotencyStore, error) {
+	err := c.Do(func(s *mongodb.Session) error {
+		return s.DB(db).C(collection).EnsureIndex(mgo.Index{
+			Key:         []string{"expireAt"},
+			ExpireAfter: time.Second,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &MongoIdempotencyStore{
+		c:          c,
+		db:         db,
+		collection: collection,
+	}, nil
+}
+
+// Begin 占用 key。mongo 的 TTL 索引不是实时删除的，过期的占用可以被接管
+func (s *MongoIdempotencyStore) Begin(key string, lock time.Duration) (bool, *IdempotentResponse, error) {
+	var (
+		ok   bool
+		resp *IdempotentResponse
+	)
+	err := s.c.DoOnce(func(ss *mongodb.Session) error {
+		coll := ss.DB(s.db).C(s.collection)
+		now := time.Now()
+		err := coll.Insert(&idempotencyDoc{ID: key, ExpireAt: now.Add(lock)})
+		if err == nil {
+			ok = true
+			return nil
+		}
+		if !mgo.IsDup(err) {
+			return err
+		}
+		doc := &idempotencyDoc{}
+		if err := coll.FindId(key).One(doc); err != nil {
+			return err
+		}
+		if now.Before(doc.ExpireAt) {
+			resp = doc.Resp
+			return nil
+		}
+		err = coll.Update(bson.M{"_id": key, "expireAt": doc.ExpireAt}, bson.M{
+			"$set":   bson.M{"expireAt": now.Add(lock)},
+			"$unset": bson.M{"resp": ""},
+		})
+		if err == mgo.ErrNotFound {
+			// 被其他请求接管
+			return nil
+		}
+		ok = err == nil
+		return err
+	})
+	return ok, resp, err
+}
+
+// Complete 保存响应
+func (s *MongoIdempotencyStore) Complete(key string, resp *IdempotentResponse, ttl time.Duration) error {
+	return s.c.Do(func(ss *mongodb.Session) error {
+		_, err := ss.DB(s.db).C(s.collection).UpsertId(key, bson.M{"$set": bson.M{
+			"resp":     resp,
+			"expireAt": time.Now().Add(ttl),
+		}})
+		return err
+	})
+}
+
+// Release 释放 key
+func (s *MongoIdempotencyStore) Release(key string) error {
+	return s.c.Do(func(ss *mongodb.Session) error {
+		err := ss.DB(s.db).C(s.collection).RemoveId(key)
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return err
+	})
+}
@@ -0,0 +1,157 @@
+package route
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// 可信代理写入的转发头
+const (
+	HeaderForwarded     = "Forwarded"
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderXRealIP       = "X-Real-IP"
+)
+
+// IPResolver 根据可信代理解析客户端IP。
+// 只有直连地址是可信代理时才读取转发头，从右向左跳过可信代理，第一个不可信的地址即为客户端IP。
+// 只读取可信代理实际写入的转发头，客户端伪造的其他转发头会原样透传，必须忽略。
+type IPResolver struct {
+	trusted []*net.IPNet
+	header  string
+}
+
+// NewIPResolver 创建IP解析器。header 为可信代理写入的转发头，如 nginx 默认的 X-Forwarded-For，
+// 可选 HeaderForwarded、HeaderXForwardedFor、HeaderXRealIP；trusted 为可信代理的 CIDR 或单个IP
+func NewIPResolver(header string, trusted ...string) (*IPResolver, error) {
+	r := &IPResolver{}
+	for _, h := range []string{HeaderForwarded, HeaderXForwardedFor, HeaderXRealIP} {
+		if strings.EqualFold(header, h) {
+			r.header = h
+		}
+	}
+	if r.header == "" {
+		return nil, fmt.Errorf("unsupported forwarding header %q", header)
+	}
+	for _, t := range trusted {
+		if !strings.Contains(t, "/") {
+			ip := net.ParseIP(t)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy ip %q", t)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			t = fmt.Sprintf("%s/%d", t, bits)
+		}
+		_, n, err := net.ParseCIDR(t)
+		if err != nil {
+			return nil, err
+		}
+		r.trusted = append(r.trusted, n)
+	}
+	return r, nil
+}
+
+func (r *IPResolver) isTrusted(ip net.IP) bool {
+	for _, n := range r.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIP 解析 1.2.3.4、1.2.3.4:80、2001:db8::1、[2001:db8::1]:80 等格式
+func parseIP(s string) net.IP {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return nil
+		}
+		s = s[1:end]
+	} else if strings.Count(s, ":") == 1 {
+		s = s[:strings.Index(s, ":")]
+	}
+	// 去掉 IPv6 zone
+	if i := strings.Index(s, "%"); i >= 0 {
+		s = s[:i]
+	}
+	return net.ParseIP(s)
+}
+
+// forwardedFor 解析 RFC 7239 Forwarded 头中的 for 参数
+func forwardedFor(values []string) []string {
+	ret := []string{}
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					ret = append(ret, kv[1])
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// forwardedChain 可信代理写入的转发链
+func (r *IPResolver) forwardedChain(h http.Header) []string {
+	values := h.Values(r.header)
+	if r.header == HeaderForwarded {
+		return forwardedFor(values)
+	}
+	ret := []string{}
+	for _, v := range values {
+		ret = append(ret, strings.Split(v, ",")...)
+	}
+	return ret
+}
+
+// ClientIP 解析客户端IP
+func (r *IPResolver) ClientIP(req *http.Request) string {
+	remote := parseIP(req.RemoteAddr)
+	if remote == nil {
+		return ""
+	}
+	if !r.isTrusted(remote) {
+		return remote.String()
+	}
+
+	chain := r.forwardedChain(req.Header)
+	client := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := parseIP(chain[i])
+		// 无法解析(如 unknown 或混淆标识)时，使用最后一个可信代理看到的地址
+		if ip == nil {
+			break
+		}
+		client = ip
+		if !r.isTrusted(ip) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// SetTrustedProxies 设置可信代理及其写入的转发头，设置后 GetIP 只信任经过可信代理转发的地址
+func (r *Router) SetTrustedProxies(header string, trusted ...string) error {
+	resolver, err := NewIPResolver(header, trusted...)
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	r.ipResolver = resolver
+	r.Unlock()
+	return nil
+}
+
+func (r *Router) getIPResolver() *IPResolver {
+	r.RLock()
+	defer r.RUnlock()
+	return r.ipResolver
+}
@@ -0,0 +1,49 @@
+package route
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPResolver(t *testing.T) {
+	if _, err := NewIPResolver("X-Client-IP", "10.0.0.0/8"); err == nil {
+		t.Fatal("unsupported header should be rejected")
+	}
+	resolvers := map[string]*IPResolver{}
+	for _, h := range []string{HeaderXForwardedFor, HeaderForwarded, "x-real-ip"} {
+		r, err := NewIPResolver(h, "10.0.0.0/8", "2001:db8::1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolvers[r.header] = r
+	}
+	cases := []struct {
+		resolver string
+		remote   string
+		header   map[string]string
+		want     string
+	}{
+		// 直连客户端伪造转发头
+		{HeaderXForwardedFor, "203.0.113.9:1234", map[string]string{"X-Forwarded-For": "1.1.1.1"}, "203.0.113.9"},
+		// 从右向左跳过可信代理
+		{HeaderXForwardedFor, "10.0.0.1:80", map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{HeaderXForwardedFor, "10.0.0.1:80", nil, "10.0.0.1"},
+		{HeaderXForwardedFor, "[2001:db8::1]:443", map[string]string{"X-Forwarded-For": "2001:db8::2"}, "2001:db8::2"},
+		// 代理只追加 X-Forwarded-For 时，客户端伪造的 Forwarded 和 X-Real-IP 被忽略
+		{HeaderXForwardedFor, "10.0.0.1:80", map[string]string{"Forwarded": "for=1.2.3.4", "X-Real-IP": "1.2.3.4", "X-Forwarded-For": "198.51.100.7"}, "198.51.100.7"},
+		{HeaderXRealIP, "10.0.0.1:80", map[string]string{"X-Real-IP": "198.51.100.7", "X-Forwarded-For": "1.2.3.4"}, "198.51.100.7"},
+		{HeaderForwarded, "10.0.0.1:80", map[string]string{"Forwarded": `for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711"`}, "2001:db8:cafe::17"},
+		{HeaderForwarded, "10.0.0.1:80", map[string]string{"Forwarded": `for=192.0.2.60, for=unknown`}, "10.0.0.1"},
+		{HeaderForwarded, "10.0.0.1:80", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "10.0.0.1"},
+	}
+	for _, cs := range cases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = cs.remote
+		for k, v := range cs.header {
+			req.Header.Set(k, v)
+		}
+		if got := resolvers[cs.resolver].ClientIP(req); got != cs.want {
+			t.Errorf("%s %s %v: got %s, want %s", cs.resolver, cs.remote, cs.header, got, cs.want)
+		}
+	}
+}
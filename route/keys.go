@@ -0,0 +1,439 @@
+package route
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// SigningMethodEdDSA Ed25519 签名，jwt-go 未内置
+var SigningMethodEdDSA = &signingMethodEdDSA{}
+
+type signingMethodEdDSA struct{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+func (m *signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, []byte(signingString), sig) {
+		return errors.New("ed25519: verification error")
+	}
+	return nil
+}
+
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(priv, []byte(signingString))), nil
+}
+
+// SigningKey jwt 签名密钥，Private 为 nil 时只能验签
+type SigningKey struct {
+	ID      string // 对应 token 头部的 kid
+	Method  jwt.SigningMethod
+	Private interface{}
+	Public  interface{}
+}
+
+// NewHMACKey HS256 对称密钥，持有者既能签发也能验签
+func NewHMACKey(kid string, secret []byte) *SigningKey {
+	return &SigningKey{
+		ID:      kid,
+		Method:  jwt.SigningMethodHS256,
+		Private: secret,
+		Public:  secret,
+	}
+}
+
+// NewRSAKey RS256 密钥
+func NewRSAKey(kid string, priv *rsa.PrivateKey) *SigningKey {
+	return &SigningKey{
+		ID:      kid,
+		Method:  jwt.SigningMethodRS256,
+		Private: priv,
+		Public:  &priv.PublicKey,
+	}
+}
+
+// NewECDSAKey ECDSA 密钥，按曲线选择 ES256/ES384/ES512
+func NewECDSAKey(kid string, priv *ecdsa.PrivateKey) (*SigningKey, error) {
+	method, err := ecdsaMethod(priv.Curve)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{
+		ID:      kid,
+		Method:  method,
+		Private: priv,
+		Public:  &priv.PublicKey,
+	}, nil
+}
+
+// NewEd25519Key EdDSA 密钥
+func NewEd25519Key(kid string, priv ed25519.PrivateKey) *SigningKey {
+	return &SigningKey{
+		ID:      kid,
+		Method:  SigningMethodEdDSA,
+		Private: priv,
+		Public:  priv.Public(),
+	}
+}
+
+// NewVerifyKey 只用于验签的公钥
+func NewVerifyKey(kid string, pub crypto.PublicKey) (*SigningKey, error) {
+	k := &SigningKey{ID: kid, Public: pub}
+	switch p := pub.(type) {
+	case *rsa.PublicKey:
+		k.Method = jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		method, err := ecdsaMethod(p.Curve)
+		if err != nil {
+			return nil, err
+		}
+		k.Method = method
+	case ed25519.PublicKey:
+		k.Method = SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+	return k, nil
+}
+
+// ParsePrivateKeyPEM 解析 PEM 格式的私钥，支持 PKCS1、PKCS8 和 EC 私钥
+func ParsePrivateKeyPEM(kid string, data []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid pem data")
+	}
+	var (
+		key interface{}
+		err error
+	)
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return NewRSAKey(kid, k), nil
+	case *ecdsa.PrivateKey:
+		return NewECDSAKey(kid, k)
+	case ed25519.PrivateKey:
+		return NewEd25519Key(kid, k), nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %T", key)
+}
+
+func ecdsaMethod(curve elliptic.Curve) (jwt.SigningMethod, error) {
+	switch curve {
+	case elliptic.P256():
+		return jwt.SigningMethodES256, nil
+	case elliptic.P384():
+		return jwt.SigningMethodES384, nil
+	case elliptic.P521():
+		return jwt.SigningMethodES512, nil
+	}
+	return nil, fmt.Errorf("unsupported curve %s", curve.Params().Name)
+}
+
+// KeySet 按 kid 管理的密钥集合。
+// 轮换时先 Add 新密钥并 SetCurrent，旧密钥保留到其签发的 token 全部过期后再 Remove。
+type KeySet struct {
+	sync.RWMutex
+	keys    map[string]*SigningKey
+	current string
+}
+
+// NewKeySet 创建密钥集合，第一个密钥为当前签发密钥
+func NewKeySet(keys ...*SigningKey) *KeySet {
+	ks := &KeySet{keys: map[string]*SigningKey{}}
+	for i, k := range keys {
+		ks.Add(k)
+		if i == 0 {
+			ks.current = k.ID
+		}
+	}
+	return ks
+}
+
+// Add 添加密钥
+func (ks *KeySet) Add(k *SigningKey) {
+	ks.Lock()
+	ks.keys[k.ID] = k
+	ks.Unlock()
+}
+
+// Remove 删除密钥
+func (ks *KeySet) Remove(kid string) {
+	ks.Lock()
+	delete(ks.keys, kid)
+	ks.Unlock()
+}
+
+// SetCurrent 设置签发使用的密钥
+func (ks *KeySet) SetCurrent(kid string) error {
+	ks.Lock()
+	defer ks.Unlock()
+	k, ok := ks.keys[kid]
+	if !ok {
+		return fmt.Errorf("key %q not found", kid)
+	}
+	if k.Private == nil {
+		return fmt.Errorf("key %q can not sign", kid)
+	}
+	ks.current = kid
+	return nil
+}
+
+// Get 获取密钥
+func (ks *KeySet) Get(kid string) (*SigningKey, bool) {
+	ks.RLock()
+	defer ks.RUnlock()
+	k, ok := ks.keys[kid]
+	return k, ok
+}
+
+// Sign 使用当前密钥签发 token
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	ks.RLock()
+	k, ok := ks.keys[ks.current]
+	ks.RUnlock()
+	if !ok || k.Private == nil {
+		return "", errors.New("no signing key")
+	}
+	token := jwt.NewWithClaims(k.Method, claims)
+	if k.ID != "" {
+		token.Header["kid"] = k.ID
+	}
+	return token.SignedString(k.Private)
+}
+
+// Keyfunc 按 token 头部的 kid 选择验签密钥，没有 kid 时使用当前密钥
+func (ks *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	ks.RLock()
+	if kid == "" {
+		kid = ks.current
+	}
+	k, ok := ks.keys[kid]
+	ks.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown kid %q", kid)
+	}
+	if token.Method.Alg() != k.Method.Alg() {
+		return nil, fmt.Errorf("Unexpected signing method %v", token.Header["alg"])
+	}
+	if k.Public == nil {
+		return nil, fmt.Errorf("key %q has no public key", kid)
+	}
+	return k.Public, nil
+}
+
+// =================== JWKS ======================
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type jwks struct {
+	Keys []*jwk `json:"keys"`
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func b64Int(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// JWKS 导出公钥为 JWKS 文档，HMAC 密钥不会导出
+func (ks *KeySet) JWKS() ([]byte, error) {
+	ks.RLock()
+	defer ks.RUnlock()
+	doc := jwks{Keys: []*jwk{}}
+	for _, k := range ks.keys {
+		j := &jwk{Kid: k.ID, Alg: k.Method.Alg(), Use: "sig"}
+		switch p := k.Public.(type) {
+		case *rsa.PublicKey:
+			j.Kty = "RSA"
+			j.N = b64(p.N.Bytes())
+			j.E = b64(big.NewInt(int64(p.E)).Bytes())
+		case *ecdsa.PublicKey:
+			size := (p.Curve.Params().BitSize + 7) / 8
+			x, y := make([]byte, size), make([]byte, size)
+			j.Kty = "EC"
+			j.Crv = p.Curve.Params().Name
+			j.X = b64(p.X.FillBytes(x))
+			j.Y = b64(p.Y.FillBytes(y))
+		case ed25519.PublicKey:
+			j.Kty = "OKP"
+			j.Crv = "Ed25519"
+			j.X = b64(p)
+		default:
+			continue
+		}
+		doc.Keys = append(doc.Keys, j)
+	}
+	return json.Marshal(doc)
+}
+
+// LoadJWKS 从 JWKS 文档加载只用于验签的密钥集合
+func LoadJWKS(data []byte) (*KeySet, error) {
+	doc := jwks{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	ks := NewKeySet()
+	for _, j := range doc.Keys {
+		k, err := parseJWK(j)
+		if err != nil {
+			return nil, fmt.Errorf("jwk %q: %v", j.Kid, err)
+		}
+		if k == nil {
+			continue
+		}
+		if ks.current == "" {
+			ks.current = k.ID
+		}
+		ks.Add(k)
+	}
+	return ks, nil
+}
+
+// LoadJWKSFile 从文件加载 JWKS
+func LoadJWKSFile(path string) (*KeySet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return LoadJWKS(data)
+}
+
+func parseJWK(j *jwk) (*SigningKey, error) {
+	if j.Use != "" && j.Use != "sig" {
+		return nil, nil
+	}
+	var pub crypto.PublicKey
+	switch j.Kty {
+	case "RSA":
+		n, err := b64Int(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64Int(j.E)
+		if err != nil {
+			return nil, err
+		}
+		pub = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", j.Crv)
+		}
+		x, err := b64Int(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64Int(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	case "OKP":
+		if j.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", j.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key size")
+		}
+		pub = ed25519.PublicKey(x)
+	default:
+		return nil, nil
+	}
+	k, err := NewVerifyKey(j.Kid, pub)
+	if err != nil {
+		return nil, err
+	}
+	if j.Alg != "" {
+		method := jwt.GetSigningMethod(j.Alg)
+		if method == nil {
+			return nil, fmt.Errorf("unsupported alg %s", j.Alg)
+		}
+		k.Method = method
+	}
+	return k, nil
+}
+
+// ServeHTTP 以 JWKS 格式下发公钥
+func (ks *KeySet) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	data, err := ks.JWKS()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(data)
+}
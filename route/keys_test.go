@@ -0,0 +1,53 @@
+package route
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestKeySetJWKS(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	es, _ := NewECDSAKey("es", ecKey)
+	signers := []*SigningKey{NewRSAKey("rs", rsaKey), es, NewEd25519Key("ed", edKey)}
+
+	ks := NewKeySet(signers...)
+	data, err := ks.JWKS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := LoadJWKS(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range signers {
+		if err := ks.SetCurrent(k.ID); err != nil {
+			t.Fatal(err)
+		}
+		st, err := ks.Sign(&UserClaims{UserID: 1})
+		if err != nil {
+			t.Fatalf("%s sign: %v", k.ID, err)
+		}
+		if _, err := jwt.ParseWithClaims(st, &UserClaims{}, verifier.Keyfunc); err != nil {
+			t.Fatalf("%s verify: %v", k.ID, err)
+		}
+	}
+
+	// 旧密钥删除后不能再验签
+	st, _ := ks.Sign(&UserClaims{UserID: 1})
+	verifier.Remove("ed")
+	if _, err := jwt.ParseWithClaims(st, &UserClaims{}, verifier.Keyfunc); err == nil {
+		t.Fatal("removed key still verifies")
+	}
+	if _, err := verifier.Sign(&UserClaims{}); err == nil {
+		t.Fatal("verify-only key set can sign")
+	}
+}
@@ -0,0 +1,108 @@
+package route
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// HeaderRequestID 请求ID头
+	HeaderRequestID = "X-Request-ID"
+	keyRequestID    = "keyRequestID"
+	keyRespCode     = "keyRespCode"
+)
+
+// AccessLog 结构化访问日志，每个请求输出一行 JSON
+type AccessLog struct {
+	Time      string  `json:"time"`
+	RequestID string  `json:"requestId"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Route     string  `json:"route,omitempty"` // 路由模板，如 /users/:id
+	Status    int     `json:"status"`
+	Code      int     `json:"code"` // BaseResponse 业务码
+	Latency   float64 `json:"latencyMs"`
+	IP        string  `json:"ip"`
+	UserID    int     `json:"userId,omitempty"`
+	UserAgent string  `json:"userAgent,omitempty"`
+	Size      int     `json:"size"`
+}
+
+// SetAccessLog 设置访问日志输出，为 nil 时不输出。默认输出到 gin.DefaultWriter
+func (r *Router) SetAccessLog(w io.Writer) {
+	r.Lock()
+	r.accessLog = w
+	r.Unlock()
+}
+
+// validRequestID 只接受长度合理的可见字符，防止日志注入
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDMiddleware 沿用请求中的 X-Request-ID，没有时生成，并写回响应头
+func requestIDMiddleware(c *gin.Context) {
+	id := c.GetHeader(HeaderRequestID)
+	if !validRequestID(id) {
+		id = newTokenID()
+	}
+	c.Set(keyRequestID, id)
+	c.Header(HeaderRequestID, id)
+}
+
+// accessLogMiddleware 请求结束后输出访问日志
+func accessLogMiddleware(w io.Writer) gin.HandlerFunc {
+	var mu sync.Mutex
+	return func(gc *gin.Context) {
+		start := time.Now()
+		gc.Next()
+
+		c := &Context{Context: gc}
+		entry := &AccessLog{
+			Time:      start.Format(time.RFC3339Nano),
+			RequestID: c.GetRequestID(),
+			Method:    c.Request.Method,
+			Path:      c.Request.URL.Path,
+			Route:     c.FullPath(),
+			Status:    c.Writer.Status(),
+			Code:      c.GetInt(keyRespCode),
+			Latency:   float64(time.Since(start).Microseconds()) / 1000,
+			IP:        c.GetIP(),
+			UserAgent: c.Request.UserAgent(),
+			Size:      c.Writer.Size(),
+		}
+		if claims := c.GetClaims(); claims != nil {
+			entry.UserID = claims.UserID
+		}
+		data, _ := json.Marshal(entry)
+		mu.Lock()
+		_, err := w.Write(append(data, '\n'))
+		mu.Unlock()
+		if err != nil {
+			c.Logger().Printf("write access log fail. %v", err)
+		}
+	}
+}
+
+// GetRequestID 获取请求ID
+func (c *Context) GetRequestID() string {
+	return c.GetString(keyRequestID)
+}
+
+// Logger 获取带请求ID前缀的日志
+func (c *Context) Logger() *log.Logger {
+	return log.New(log.Writer(), "["+c.GetRequestID()+"] ", log.Flags())
+}
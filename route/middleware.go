@@ -1,33 +1,41 @@
 package route
 
 import (
-	"fmt"
-	"log"
+	"errors"
 	"net/http"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
+	"github.com/skiplee85/common/tenant"
 )
 
-func authMiddleware(c *gin.Context) {
-	auth := c.GetHeader("Authorization")
-	if auth == "" {
-		log.Printf("Authorization empty. %s %s", c.Request.Method, c.Request.URL)
-		c.AbortWithStatusJSON(http.StatusUnauthorized, &BaseResponse{Code: http.StatusUnauthorized})
-		return
-	}
-
-	claims, code := parseToken(auth)
-	if code == http.StatusOK {
+func (r *Router) authMiddleware(a Authenticator, mode AuthMode) gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		c := &Context{Context: gc, router: r}
 		role := c.GetInt(KeyRole)
+		claims, err := a.Authenticate(c)
+		if err == ErrNoCredentials {
+			if mode == AuthOptional && role == 0 {
+				return
+			}
+			c.Logger().Printf("Authorization empty. %s %s", c.Request.Method, c.Request.URL)
+			c.abortResponse(http.StatusUnauthorized, &BaseResponse{Code: http.StatusUnauthorized})
+			return
+		}
+		if err != nil {
+			c.Logger().Printf("Authorization fail. %s %s %v", c.Request.Method, c.Request.URL, err)
+			c.abortResponse(http.StatusOK, &BaseResponse{Code: http.StatusUnauthorized})
+			return
+		}
 		if role > claims.Role {
-			c.AbortWithStatusJSON(http.StatusForbidden, &BaseResponse{Code: http.StatusForbidden})
-		} else {
-			c.Set(keyUserClaims, claims)
+			c.abortResponse(http.StatusForbidden, &BaseResponse{Code: http.StatusForbidden})
+			return
+		}
+		c.Set(keyUserClaims, claims)
+		if claims.TenantID != "" {
+			c.Request = c.Request.WithContext(tenant.NewContext(c.Request.Context(), claims.TenantID))
 		}
-	} else {
-		c.AbortWithStatusJSON(http.StatusOK, &BaseResponse{Code: code})
 	}
 }
 
@@ -37,36 +45,59 @@ func getRoleMiddleware(role int) gin.HandlerFunc {
 	}
 }
 
-func parseToken(auth string) (*UserClaims, int) {
-	token, err := jwt.ParseWithClaims(auth, &UserClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method %v", token.Header["alg"])
-		}
-		return []byte(jwtSecret), nil
-	})
+// VerifyToken 校验访问 token，拒绝刷新 token 和已吊销的 token
+func (r *Router) VerifyToken(auth string) (*UserClaims, error) {
+	ks := r.GetKeySet()
+	if ks == nil {
+		return nil, errors.New("no verify key")
+	}
+	token, err := jwt.ParseWithClaims(auth, &UserClaims{}, ks.Keyfunc)
 	if err != nil {
-		log.Printf("Parse Authorization Fail. %s %+v", auth, err)
-		return nil, http.StatusUnauthorized
+		return nil, err
 	}
 
 	claims, ok := token.Claims.(*UserClaims)
 	if ok == false || token.Valid == false {
-		return nil, http.StatusUnauthorized
+		return nil, errors.New("invalid token")
+	}
+	if claims.TokenType == TokenTypeRefresh {
+		return nil, errors.New("refresh token can not be used as access token")
 	}
-	return claims, http.StatusOK
+	if r.isRevoked(claims) {
+		return nil, errors.New("token revoked")
+	}
+	return claims, nil
 }
 
-// GenJwtToken 生成jwtToken
+// GenJwtToken 使用默认路由的密钥生成jwtToken
 func GenJwtToken(userID, role, expire int) (*UserClaims, string, error) {
-	expireToken := time.Now().Add(time.Duration(expire) * time.Second).Unix()
-	claims := UserClaims{
+	return defaultRouter.GenJwtToken(userID, role, expire)
+}
+
+// GenJwtTokenWithClaims 使用默认路由的密钥和自定义信息包生成jwtToken，会覆盖 ExpiresAt
+func GenJwtTokenWithClaims(claims *UserClaims, expire int) (string, error) {
+	return defaultRouter.GenJwtTokenWithClaims(claims, expire)
+}
+
+// GenJwtToken 生成jwtToken
+func (r *Router) GenJwtToken(userID, role, expire int) (*UserClaims, string, error) {
+	claims := &UserClaims{
 		UserID: userID,
 		Role:   role,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expireToken,
-		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	st, err := token.SignedString([]byte(jwtSecret))
-	return &claims, st, err
+	st, err := r.GenJwtTokenWithClaims(claims, expire)
+	return claims, st, err
+}
+
+// GenJwtTokenWithClaims 使用自定义信息包生成jwtToken，会覆盖 ExpiresAt，Id 为空时生成 jti
+func (r *Router) GenJwtTokenWithClaims(claims *UserClaims, expire int) (string, error) {
+	ks := r.GetKeySet()
+	if ks == nil {
+		return "", errors.New("no signing key")
+	}
+	claims.ExpiresAt = time.Now().Add(time.Duration(expire) * time.Second).Unix()
+	if claims.Id == "" {
+		claims.Id = newTokenID()
+	}
+	return ks.Sign(claims)
 }
@@ -9,25 +9,39 @@ const (
 	CodeOk = 0
 	// CodeErrorRequest 非法请求
 	CodeErrorRequest = 400
+	// CodeErrorConflict 请求冲突，如相同幂等键的请求正在处理
+	CodeErrorConflict = 409
+	// CodeErrorTooManyRequests 请求过于频繁
+	CodeErrorTooManyRequests = 429
 	// CodeErrorInternal 服务器内部错误
 	CodeErrorInternal = 500
+	// CodeErrorUnavailable 依赖的服务不可用
+	CodeErrorUnavailable = 503
+	// CodeErrorTimeout 处理超时
+	CodeErrorTimeout = 504
 	// CodeErrorInvalidArguments 非法参数
 	CodeErrorInvalidArguments = 1000
 )
 
 // UserClaims 用户jwt结构
 type UserClaims struct {
-	UserID int
-	Role   int
+	UserID    int
+	Role      int
+	TenantID  string   `json:",omitempty"`    // 租户ID，多租户部署时使用
+	TokenType string   `json:"typ,omitempty"` // token 类型，刷新 token 为 refresh
+	Scopes    []string `json:",omitempty"`    // 额外授予的权限，与角色权限合并
+	Locale    string   `json:",omitempty"`    // 用户语言，优先于 Accept-Language
 	jwt.StandardClaims
 }
 
 // BaseResponse API 公共响应参数
 type BaseResponse struct {
-	Code       int         `json:"code"`
-	Msg        string      `json:"msg,omitempty"`
-	Data       interface{} `json:"data,omitempty"`
-	Pagination *Pagination `json:"pagination,omitempty"`
+	Code       int          `json:"code"`
+	Msg        string       `json:"msg,omitempty"`
+	Data       interface{}  `json:"data,omitempty"`
+	Pagination *Pagination  `json:"pagination,omitempty"`
+	Details    interface{}  `json:"details,omitempty"` // 错误的附加信息
+	Errors     []FieldError `json:"errors,omitempty"`  // 参数校验错误
 }
 
 // Pagination 分页
@@ -0,0 +1,515 @@
+package route
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RouteDoc 路由文档，用于生成 OpenAPI
+type RouteDoc struct {
+	Summary     string
+	Description string
+	Tags        []string
+	Args        interface{} // 参数结构体，按 ValidaArgs 的 form/json/binding 标签生成
+	Resp        interface{} // BaseResponse.Data 的类型
+	Deprecated  bool
+}
+
+// OpenAPIInfo 文档信息
+type OpenAPIInfo struct {
+	Title       string
+	Version     string
+	Description string
+	SpecPath    string // 文档路径，默认 /openapi.json
+	UIPath      string // Swagger UI 路径，为空时不提供
+	UIAssets    *SwaggerUIAssets
+}
+
+// SwaggerUIAssets Swagger UI 的静态资源，默认使用 unpkg 上固定版本的 swagger-ui-dist。
+// 生产环境建议指向自己托管的资源，或设置 Integrity 启用子资源完整性校验
+type SwaggerUIAssets struct {
+	ScriptURL       string
+	ScriptIntegrity string // 如 sha384-...，为空时不校验
+	StyleURL        string
+	StyleIntegrity  string
+}
+
+// DefaultSwaggerUIVersion 默认的 swagger-ui-dist 版本
+const DefaultSwaggerUIVersion = "5.17.14"
+
+func (a *SwaggerUIAssets) withDefaults() *SwaggerUIAssets {
+	ret := &SwaggerUIAssets{}
+	if a != nil {
+		*ret = *a
+	}
+	base := "https://unpkg.com/swagger-ui-dist@" + DefaultSwaggerUIVersion
+	if ret.ScriptURL == "" {
+		ret.ScriptURL = base + "/swagger-ui-bundle.js"
+	}
+	if ret.StyleURL == "" {
+		ret.StyleURL = base + "/swagger-ui.css"
+	}
+	return ret
+}
+
+// ServeOpenAPI 根据路由表生成 OpenAPI 3 文档并提供 Swagger UI，这两个路由不需要授权
+func (r *Router) ServeOpenAPI(info *OpenAPIInfo) {
+	r.Lock()
+	r.openAPI = info
+	r.Unlock()
+}
+
+func (r *Router) serveOpenAPI(engine *gin.Engine, routeConf []*BaseRoute) {
+	r.RLock()
+	info := r.openAPI
+	r.RUnlock()
+	if info == nil {
+		return
+	}
+	specPath := info.SpecPath
+	if specPath == "" {
+		specPath = "/openapi.json"
+	}
+	spec := r.OpenAPI(routeConf, info)
+	engine.GET(specPath, func(c *gin.Context) {
+		c.JSON(http.StatusOK, spec)
+	})
+	if info.UIPath != "" {
+		page := &bytes.Buffer{}
+		err := swaggerUI.Execute(page, map[string]interface{}{
+			"Title":  info.Title,
+			"Spec":   specPath,
+			"Assets": info.UIAssets.withDefaults(),
+		})
+		if err != nil {
+			panic(err)
+		}
+		engine.GET(info.UIPath, func(c *gin.Context) {
+			c.Data(http.StatusOK, "text/html; charset=utf-8", page.Bytes())
+		})
+	}
+}
+
+var swaggerUI = template.Must(template.New("swagger").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<link rel="stylesheet" href="{{.Assets.StyleURL}}"{{with .Assets.StyleIntegrity}} integrity="{{.}}" crossorigin="anonymous"{{end}}>
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="{{.Assets.ScriptURL}}"{{with .Assets.ScriptIntegrity}} integrity="{{.}}" crossorigin="anonymous"{{end}}></script>
+<script>
+window.onload = function() {
+  SwaggerUIBundle({url: {{.Spec}}, dom_id: "#swagger-ui"});
+};
+</script>
+</body>
+</html>`))
+
+// OpenAPI 根据路由表生成 OpenAPI 3 文档
+func (r *Router) OpenAPI(routeConf []*BaseRoute, info *OpenAPIInfo) map[string]interface{} {
+	g := &openAPIGen{
+		paths:   map[string]map[string]interface{}{},
+		schemas: map[string]interface{}{},
+		names:   map[schemaKey]string{},
+	}
+	g.schema(reflect.TypeOf(Pagination{}), "json")
+	r.RLock()
+	defaultAuth := r.defaultAuth
+	r.RUnlock()
+	scope := &routeScope{
+		auth:          defaultAuth,
+		authenticator: r.getAuthenticator(),
+	}
+	for _, rc := range routeConf {
+		g.walk(rc, "/", scope)
+	}
+
+	paths := map[string]interface{}{}
+	for p, ops := range g.paths {
+		paths[p] = ops
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       info.Title,
+			"version":     info.Version,
+			"description": info.Description,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{
+					"type":         "http",
+					"scheme":       "bearer",
+					"bearerFormat": "JWT",
+				},
+			},
+		},
+	}
+}
+
+type openAPIGen struct {
+	paths   map[string]map[string]interface{}
+	schemas map[string]interface{}
+	names   map[schemaKey]string
+}
+
+// schemaKey 同一类型按 json 和 form 标签生成的 schema 不同，分开缓存
+type schemaKey struct {
+	t   reflect.Type
+	tag string
+}
+
+// openAPIPath 将 gin 的 :id 和 *path 转为 {id} 和 {path}
+func openAPIPath(p string) (string, []string) {
+	segments := strings.Split(p, "/")
+	params := []string{}
+	for i, s := range segments {
+		if strings.HasPrefix(s, ":") || strings.HasPrefix(s, "*") {
+			params = append(params, s[1:])
+			segments[i] = "{" + s[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/"), params
+}
+
+func (g *openAPIGen) walk(rConf *BaseRoute, prefix string, parent *routeScope) {
+	scope := *parent
+	if rConf.Role > 0 {
+		scope.role = rConf.Role
+	}
+	if rConf.Auth != AuthInherit {
+		scope.auth = rConf.Auth
+	}
+	if rConf.Authenticator != nil {
+		scope.authenticator = rConf.Authenticator
+	}
+	if len(rConf.Permissions) > 0 || rConf.Owner != nil {
+		scope.needClaims = true
+	}
+	full := path.Join(prefix, rConf.Path)
+	if strings.HasSuffix(rConf.Path, "/") && !strings.HasSuffix(full, "/") {
+		full += "/"
+	}
+	if len(rConf.Child) > 0 {
+		for _, rr := range rConf.Child {
+			g.walk(rr, full, &scope)
+		}
+		return
+	}
+
+	p, pathParams := openAPIPath(full)
+	method := strings.ToLower(rConf.Method)
+	op := map[string]interface{}{}
+	params := []interface{}{}
+	for _, name := range pathParams {
+		params = append(params, map[string]interface{}{
+			"name":     name,
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]interface{}{"type": "string"},
+		})
+	}
+
+	var resp interface{}
+	if doc := rConf.Doc; doc != nil {
+		if doc.Summary != "" {
+			op["summary"] = doc.Summary
+		}
+		if doc.Description != "" {
+			op["description"] = doc.Description
+		}
+		if len(doc.Tags) > 0 {
+			op["tags"] = doc.Tags
+		}
+		if doc.Deprecated {
+			op["deprecated"] = true
+		}
+		if doc.Args != nil {
+			t := reflect.TypeOf(doc.Args)
+			if method == "get" || method == "delete" || method == "head" {
+				params = append(params, g.queryParams(t)...)
+			} else {
+				op["requestBody"] = map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": g.schema(t, "json")},
+					},
+				}
+			}
+		}
+		resp = doc.Resp
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	op["responses"] = map[string]interface{}{
+		"200": map[string]interface{}{
+			"description": "BaseResponse，code 为 0 时成功",
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": g.envelope(resp)},
+			},
+		},
+	}
+	if scope.secured() {
+		op["security"] = []interface{}{map[string]interface{}{"bearerAuth": []string{}}}
+	}
+	if scope.role > 0 {
+		op["x-role"] = scope.role
+	}
+	if len(rConf.Permissions) > 0 {
+		op["x-permissions"] = rConf.Permissions
+	}
+
+	if g.paths[p] == nil {
+		g.paths[p] = map[string]interface{}{}
+	}
+	g.paths[p][method] = op
+}
+
+// envelope BaseResponse 包装
+func (g *openAPIGen) envelope(resp interface{}) map[string]interface{} {
+	data := map[string]interface{}{}
+	if resp != nil {
+		data = g.schema(reflect.TypeOf(resp), "json")
+	}
+	return map[string]interface{}{
+		"type":     "object",
+		"required": []string{"code"},
+		"properties": map[string]interface{}{
+			"code":       map[string]interface{}{"type": "integer"},
+			"msg":        map[string]interface{}{"type": "string"},
+			"data":       data,
+			"pagination": map[string]interface{}{"$ref": "#/components/schemas/Pagination"},
+		},
+	}
+}
+
+// queryParams 按 form 标签展开为 query 参数
+func (g *openAPIGen) queryParams(t reflect.Type) []interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	ret := []interface{}{}
+	if t.Kind() != reflect.Struct {
+		return ret
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		// 路径参数已经单独生成
+		if f.PkgPath != "" || f.Tag.Get("uri") != "" {
+			continue
+		}
+		if f.Anonymous && f.Tag.Get("form") == "" {
+			ret = append(ret, g.queryParams(f.Type)...)
+			continue
+		}
+		name := fieldName(f, "form")
+		if name == "" {
+			continue
+		}
+		s := g.schema(f.Type, "form")
+		applyBinding(s, f)
+		ret = append(ret, map[string]interface{}{
+			"name":     name,
+			"in":       "query",
+			"required": isRequired(f),
+			"schema":   s,
+		})
+	}
+	return ret
+}
+
+// fieldName 字段名，tag 为 - 时返回空
+func fieldName(f reflect.StructField, tag string) string {
+	name := strings.Split(f.Tag.Get(tag), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+func isRequired(f reflect.StructField) bool {
+	for _, rule := range strings.Split(f.Tag.Get("binding"), ",") {
+		if rule == "required" {
+			return true
+		}
+	}
+	return false
+}
+
+// applyBinding 将 binding 标签中的常用规则转为 schema 约束
+func applyBinding(s map[string]interface{}, f reflect.StructField) {
+	if _, ok := s["$ref"]; ok {
+		return
+	}
+	typ, _ := s["type"].(string)
+	for _, rule := range strings.Split(f.Tag.Get("binding"), ",") {
+		kv := strings.SplitN(rule, "=", 2)
+		if len(kv) == 1 {
+			switch kv[0] {
+			case "email":
+				s["format"] = "email"
+			case "url":
+				s["format"] = "uri"
+			}
+			continue
+		}
+		n, _ := strconv.ParseFloat(kv[1], 64)
+		switch kv[0] {
+		case "min", "gte":
+			switch typ {
+			case "string":
+				s["minLength"] = int(n)
+			case "array":
+				s["minItems"] = int(n)
+			default:
+				s["minimum"] = n
+			}
+		case "max", "lte":
+			switch typ {
+			case "string":
+				s["maxLength"] = int(n)
+			case "array":
+				s["maxItems"] = int(n)
+			default:
+				s["maximum"] = n
+			}
+		case "oneof":
+			enum := []interface{}{}
+			for _, v := range strings.Fields(kv[1]) {
+				if typ == "integer" || typ == "number" {
+					n, _ := strconv.ParseFloat(v, 64)
+					enum = append(enum, n)
+				} else {
+					enum = append(enum, v)
+				}
+			}
+			s["enum"] = enum
+		}
+	}
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	marshalerType = reflect.TypeOf((*interface{ MarshalJSON() ([]byte, error) })(nil)).Elem()
+)
+
+// schema 根据类型生成 schema，具名结构体放到 components 中引用
+func (g *openAPIGen) schema(t reflect.Type, tag string) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType || (t.Kind() == reflect.Struct && t.ConvertibleTo(timeType)) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem(), tag)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem(), tag)}
+	case reflect.Struct:
+		if t.Implements(marshalerType) || reflect.PtrTo(t).Implements(marshalerType) {
+			// 自定义序列化的类型无法推断结构，例如 utils.Time
+			if t.Name() == "Time" {
+				return map[string]interface{}{"type": "string", "example": "2006-01-02 15:04:05"}
+			}
+			return map[string]interface{}{}
+		}
+		if t.Name() == "" {
+			return g.structSchema(t, tag)
+		}
+		key := schemaKey{t, tag}
+		name, ok := g.names[key]
+		if !ok {
+			base := t.Name()
+			if tag != "json" {
+				base += "_" + tag
+			}
+			name = base
+			if _, dup := g.schemas[name]; dup {
+				name = strings.Replace(t.PkgPath(), "/", ".", -1) + "." + base
+			}
+			for i := 2; ; i++ {
+				if _, dup := g.schemas[name]; !dup {
+					break
+				}
+				name = base + strconv.Itoa(i)
+			}
+			g.names[key] = name
+			// 先占位，防止递归类型死循环
+			g.schemas[name] = map[string]interface{}{}
+			g.schemas[name] = g.structSchema(t, tag)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+func (g *openAPIGen) structSchema(t reflect.Type, tag string) map[string]interface{} {
+	props := map[string]interface{}{}
+	required := []string{}
+	var collect func(t reflect.Type)
+	collect = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" || f.Tag.Get("uri") != "" {
+				continue
+			}
+			ft := f.Type
+			for ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if f.Anonymous && f.Tag.Get(tag) == "" && ft.Kind() == reflect.Struct {
+				collect(ft)
+				continue
+			}
+			name := fieldName(f, tag)
+			if name == "" {
+				continue
+			}
+			s := g.schema(f.Type, tag)
+			applyBinding(s, f)
+			props[name] = s
+			if isRequired(f) {
+				required = append(required, name)
+			}
+		}
+	}
+	collect(t)
+	s := map[string]interface{}{
+		"type":       "object",
+		"properties": props,
+	}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
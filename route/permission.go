@@ -0,0 +1,103 @@
+package route
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PermissionMode 多个权限的匹配方式
+type PermissionMode int
+
+const (
+	// PermissionAll 需要拥有全部权限
+	PermissionAll PermissionMode = iota
+	// PermissionAny 拥有任意一个权限即可
+	PermissionAny
+)
+
+// OwnerFunc 资源所有者检查，返回 false 时拒绝访问
+type OwnerFunc func(c *Context, claims *UserClaims) bool
+
+// SetRolePermissions 设置角色拥有的权限，权限支持 orders:* 和 * 通配
+func (r *Router) SetRolePermissions(perms map[int][]string) {
+	r.Lock()
+	r.rolePerms = perms
+	r.Unlock()
+}
+
+// GetPermissions 获取用户拥有的权限，为角色权限和 token 中 Scopes 的并集
+func (r *Router) GetPermissions(claims *UserClaims) []string {
+	r.RLock()
+	rp := r.rolePerms[claims.Role]
+	r.RUnlock()
+	perms := make([]string, 0, len(rp)+len(claims.Scopes))
+	perms = append(perms, rp...)
+	return append(perms, claims.Scopes...)
+}
+
+// matchPermission granted 是否包含 perm
+func matchPermission(granted []string, perm string) bool {
+	for _, g := range granted {
+		if g == perm || g == "*" {
+			return true
+		}
+		if strings.HasSuffix(g, ":*") && strings.HasPrefix(perm, g[:len(g)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkPermissions(granted []string, mode PermissionMode, perms []string) bool {
+	for _, p := range perms {
+		ok := matchPermission(granted, p)
+		if mode == PermissionAny && ok {
+			return true
+		}
+		if mode == PermissionAll && !ok {
+			return false
+		}
+	}
+	return mode == PermissionAll || len(perms) == 0
+}
+
+// HasPermission 当前用户是否拥有权限
+func (c *Context) HasPermission(perms ...string) bool {
+	claims := c.GetClaims()
+	if claims == nil {
+		return false
+	}
+	return checkPermissions(c.GetRouter().GetPermissions(claims), PermissionAll, perms)
+}
+
+// RequirePermissions 权限检查中间件，需要放在授权之后
+func RequirePermissions(mode PermissionMode, perms ...string) gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		c := &Context{Context: gc}
+		claims := c.GetClaims()
+		if claims == nil {
+			c.abortResponse(http.StatusUnauthorized, &BaseResponse{Code: http.StatusUnauthorized})
+			return
+		}
+		if !checkPermissions(c.GetRouter().GetPermissions(claims), mode, perms) {
+			c.abortResponse(http.StatusForbidden, &BaseResponse{Code: http.StatusForbidden})
+		}
+	}
+}
+
+// RequireOwner 资源所有者检查中间件，需要放在授权之后
+func RequireOwner(fn OwnerFunc) gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		c := &Context{Context: gc}
+		claims := c.GetClaims()
+		if claims == nil {
+			c.abortResponse(http.StatusUnauthorized, &BaseResponse{Code: http.StatusUnauthorized})
+			return
+		}
+		if !fn(c, claims) {
+			c.abortResponse(http.StatusForbidden, &BaseResponse{Code: http.StatusForbidden})
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package route
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skiplee85/common/mongodb"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// RateLimitKeyFunc 限流的键，返回空字符串时不限流
+type RateLimitKeyFunc func(c *Context) string
+
+// KeyByIP 按客户端IP限流。Router 没有通过 SetTrustedProxies 设置可信代理时使用连接的
+// 对端地址，不信任客户端可以伪造的 X-Forwarded-For 等请求头。部署在代理后面时必须设置可信代理，
+// 否则所有请求共享代理的令牌桶
+func KeyByIP(c *Context) string {
+	if c.GetRouter().getIPResolver() == nil {
+		ip, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+		if err != nil {
+			ip = c.Request.RemoteAddr
+		}
+		return "ip:" + ip
+	}
+	return "ip:" + c.GetIP()
+}
+
+// KeyByUser 按用户限流，未授权的请求按IP限流
+func KeyByUser(c *Context) string {
+	if claims := c.GetClaims(); claims != nil {
+		return "user:" + strconv.Itoa(claims.UserID)
+	}
+	return KeyByIP(c)
+}
+
+// RateLimitResult 一次取令牌的结果
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int           // 剩余令牌数
+	RetryAfter time.Duration // 被限流时下一个令牌的等待时间
+	Reset      time.Duration // 令牌桶恢复满的时间
+}
+
+// RateLimitStore 令牌桶存储，rate 为每秒生成的令牌数，burst 为桶容量
+type RateLimitStore interface {
+	Take(key string, rate float64, burst int) (*RateLimitResult, error)
+}
+
+// RateLimit 限流配置，Period 内最多 Limit 个请求
+type RateLimit struct {
+	Limit  int
+	Period time.Duration
+	Burst  int              // 桶容量，默认等于 Limit
+	Key    RateLimitKeyFunc // 默认 KeyByIP
+	Store  RateLimitStore   // 默认使用 Router 的存储
+}
+
+// SetRateLimitStore 设置默认的令牌桶存储，多实例部署时使用 MongoRateLimitStore
+func (r *Router) SetRateLimitStore(s RateLimitStore) {
+	r.Lock()
+	r.rateLimitStore = s
+	r.Unlock()
+}
+
+func (r *Router) getRateLimitStore() RateLimitStore {
+	r.Lock()
+	defer r.Unlock()
+	if r.rateLimitStore == nil {
+		r.rateLimitStore = NewMemoryRateLimitStore()
+	}
+	return r.rateLimitStore
+}
+
+// RateLimitMiddleware 限流中间件，name 用于区分不同路由的令牌桶。
+// Limit 和 Period 必须大于 0，否则 panic，配置错误在创建路由时暴露
+func RateLimitMiddleware(name string, rl *RateLimit) gin.HandlerFunc {
+	if rl.Limit <= 0 || rl.Period <= 0 {
+		panic(fmt.Sprintf("route: invalid rate limit for %s: Limit=%d Period=%v", name, rl.Limit, rl.Period))
+	}
+	burst := rl.Burst
+	if burst <= 0 {
+		burst = rl.Limit
+	}
+	rate := float64(rl.Limit) / rl.Period.Seconds()
+	keyFunc := rl.Key
+	if keyFunc == nil {
+		keyFunc = KeyByIP
+	}
+	return func(gc *gin.Context) {
+		c := &Context{Context: gc}
+		key := keyFunc(c)
+		if key == "" {
+			return
+		}
+		store := rl.Store
+		if store == nil {
+			store = c.GetRouter().getRateLimitStore()
+		}
+		res, err := store.Take(name+"|"+key, rate, burst)
+		if err != nil {
+			// 存储不可用时放行
+			c.Logger().Printf("rate limit store error. %s %v", key, err)
+			return
+		}
+		h := c.Writer.Header()
+		h.Set("X-RateLimit-Limit", strconv.Itoa(burst))
+		h.Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		h.Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(res.Reset.Seconds()))))
+		if !res.Allowed {
+			h.Set("Retry-After", strconv.Itoa(int(math.Ceil(res.RetryAfter.Seconds()))))
+			c.abortResponse(http.StatusTooManyRequests, &BaseResponse{
+				Code: CodeErrorTooManyRequests,
+				Msg:  c.ErrorMsg(CodeErrorTooManyRequests, nil),
+			})
+		}
+	}
+}
+
+// bucket 令牌桶状态
+type bucket struct {
+	Tokens float64 `bson:"tokens"`
+	Last   int64   `bson:"last"` // 上次更新时间(纳秒)
+}
+
+// take 补充令牌后取一个令牌
+func (b *bucket) take(now time.Time, rate float64, burst int) *RateLimitResult {
+	tokens := float64(burst)
+	if b.Last > 0 {
+		elapsed := now.Sub(time.Unix(0, b.Last)).Seconds()
+		if elapsed < 0 {
+			elapsed = 0
+		}
+		tokens = math.Min(float64(burst), b.Tokens+elapsed*rate)
+	}
+	res := &RateLimitResult{}
+	if tokens >= 1 {
+		tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	b.Tokens = tokens
+	b.Last = now.UnixNano()
+	res.Remaining = int(tokens)
+	res.Reset = time.Duration((float64(burst) - tokens) / rate * float64(time.Second))
+	return res
+}
+
+// =================== memory ======================
+
+// MemoryRateLimitStore 进程内令牌桶，只适合单实例部署
+type MemoryRateLimitStore struct {
+	sync.Mutex
+	buckets map[string]*bucket
+	resets  map[string]time.Time
+	sweepAt time.Time
+}
+
+// NewMemoryRateLimitStore 创建进程内令牌桶存储
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets: map[string]*bucket{},
+		resets:  map[string]time.Time{},
+	}
+}
+
+// Take 取令牌
+func (s *MemoryRateLimitStore) Take(key string, rate float64, burst int) (*RateLimitResult, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	// 定期清理已经恢复满的令牌桶
+	if now.After(s.sweepAt) {
+		for k, t := range s.resets {
+			if now.After(t) {
+				delete(s.buckets, k)
+				delete(s.resets, k)
+			}
+		}
+		s.sweepAt = now.Add(time.Minute)
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{}
+		s.buckets[key] = b
+	}
+	res := b.take(now, rate, burst)
+	s.resets[key] = now.Add(res.Reset)
+	return res, nil
+}
+
+// =================== mongo ======================
+
+// MongoRateLimitStore 基于 mongo 的令牌桶，多实例共享，使用乐观锁更新，多次冲突后拒绝请求
+type MongoRateLimitStore struct {
+	c          *mongodb.DialContext
+	db         string
+	collection string
+}
+
+// NewMongoRateLimitStore 创建 mongo 令牌桶存储
+func NewMongoRateLimitStore(c *mongodb.DialContext, db string, collection string) (*MongoRateLimitStore, error) {
+	err := c.Do(func(s *mongodb.Session) error {
+		return s.DB(db).C(collection).EnsureIndex(mgo.Index{
+			Key:         []string{"expireAt"},
+			ExpireAfter: time.Second,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &MongoRateLimitStore{
+		c:          c,
+		db:         db,
+		collection: collection,
+	}, nil
+}
+
+// Take 取令牌
+func (s *MongoRateLimitStore) Take(key string, rate float64, burst int) (*RateLimitResult, error) {
+	var (
+		res *RateLimitResult
+		err error
+	)
+	for i := 0; i < 5; i++ {
+		err = s.c.DoOnce(func(ss *mongodb.Session) error {
+			coll := ss.DB(s.db).C(s.collection)
+			b := &bucket{}
+			err := coll.FindId(key).One(b)
+			if err != nil && err != mgo.ErrNotFound {
+				return err
+			}
+			old := *b
+			now := time.Now()
+			res = b.take(now, rate, burst)
+			doc := bson.M{
+				"tokens":   b.Tokens,
+				"last":     b.Last,
+				"expireAt": now.Add(res.Reset),
+			}
+			if err == mgo.ErrNotFound {
+				doc["_id"] = key
+				return coll.Insert(doc)
+			}
+			return coll.Update(bson.M{"_id": key, "last": old.Last}, bson.M{"$set": doc})
+		})
+		// 并发冲突时重试
+		if err == mgo.ErrNotFound || mgo.IsDup(err) {
+			continue
+		}
+		return res, err
+	}
+	// 多次冲突说明同一个 key 的并发很高，拒绝请求，不能当作存储错误放行
+	wait := time.Duration(float64(time.Second) / rate)
+	return &RateLimitResult{RetryAfter: wait, Reset: wait}, nil
+}
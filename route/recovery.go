@@ -0,0 +1,72 @@
+package route
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handlerPanic 在其他位置捕获后重新抛出的 panic，保留原始的调用栈
+type handlerPanic struct {
+	value interface{}
+	stack []byte
+}
+
+// newHandlerPanic 在 recover 的 defer 中调用，记录 panic 时的调用栈
+func newHandlerPanic(p interface{}) interface{} {
+	if _, ok := p.(*handlerPanic); ok || p == http.ErrAbortHandler {
+		return p
+	}
+	return &handlerPanic{value: p, stack: debug.Stack()}
+}
+
+// recoveryMiddleware 捕获 panic，记录带请求ID的调用栈，并下发 CodeErrorInternal
+func recoveryMiddleware(gc *gin.Context) {
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		stack := debug.Stack()
+		if hp, ok := p.(*handlerPanic); ok {
+			p, stack = hp.value, hp.stack
+		}
+		if p == http.ErrAbortHandler {
+			panic(p)
+		}
+		c := &Context{Context: gc}
+		c.Logger().Printf("panic recovered. %s %s %v\n%s", c.Request.Method, c.Request.URL, p, stack)
+		// 连接已断开时无法下发
+		if err, ok := p.(error); ok && isBrokenPipe(err) {
+			c.Abort()
+			return
+		}
+		if c.Writer.Written() {
+			c.Abort()
+			return
+		}
+		c.abortResponse(http.StatusInternalServerError, &BaseResponse{
+			Code: CodeErrorInternal,
+			Msg:  c.ErrorMsg(CodeErrorInternal, nil),
+		})
+	}()
+	gc.Next()
+}
+
+func isBrokenPipe(err error) bool {
+	var ne *net.OpError
+	if !errors.As(err, &ne) {
+		return false
+	}
+	var se *os.SyscallError
+	if !errors.As(ne, &se) {
+		return false
+	}
+	msg := strings.ToLower(se.Error())
+	return strings.Contains(msg, "broken pipe") || strings.Contains(msg, "connection reset by peer")
+}
@@ -0,0 +1,266 @@
+package route
+
+import (
+	"io"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skiplee85/common/mongodb"
+)
+
+var defaultRouter = NewRouter("")
+
+// Router 路由实例，持有自己的 jwt 密钥、错误码表、跨域配置和中间件。
+// 同一进程内可以创建多个 Router 分别服务不同的路由表。
+type Router struct {
+	sync.RWMutex
+	keys          *KeySet
+	jwksPath      string
+	revocation    RevocationStore
+	authenticator Authenticator
+	defaultAuth   AuthMode
+	rolePerms     map[int][]string
+	errMsg        map[int]string
+	errStatus     []StatusRange
+	respPolicy    ResponsePolicy
+	catalog       *Catalog
+	cors          *CORSOptions
+	middlewares   []gin.HandlerFunc
+
+	rateLimitStore   RateLimitStore
+	idempotencyStore IdempotencyStore
+	respCache        mongodb.Cache
+	ipResolver       *IPResolver
+	accessLog        io.Writer
+	openAPI          *OpenAPIInfo
+}
+
+// NewRouter 创建路由实例，jwtSecret 为空时不校验 token
+func NewRouter(jwtSecret string) *Router {
+	r := &Router{
+		errMsg: map[int]string{
+			CodeOk:                    "success",
+			CodeErrorRequest:          "error request",
+			CodeErrorConflict:         "request conflict.",
+			CodeErrorTooManyRequests:  "too many requests.",
+			CodeErrorInternal:         "server error.",
+			CodeErrorUnavailable:      "service unavailable.",
+			CodeErrorTimeout:          "request timeout.",
+			CodeErrorInvalidArguments: "invalid arguments.",
+		},
+		cors:        DefaultCORSOptions(),
+		defaultAuth: AuthRequired,
+		accessLog:   gin.DefaultWriter,
+	}
+	r.SetJwtSecret(jwtSecret)
+	return r
+}
+
+// DefaultRouter 获取 GetRouteHandler 使用的默认路由
+func DefaultRouter() *Router {
+	return defaultRouter
+}
+
+// SetJwtSecret 使用 HS256 对称密钥，为空时不校验 token
+func (r *Router) SetJwtSecret(secret string) {
+	var ks *KeySet
+	if secret != "" {
+		ks = NewKeySet(NewHMACKey("", []byte(secret)))
+	}
+	r.SetKeySet(ks)
+}
+
+// SetKeySet 设置签发和验签使用的密钥集合，为 nil 时不校验 token。
+// 只持有公钥的服务可以通过 LoadJWKS 加载密钥集合，只验签不能签发。
+func (r *Router) SetKeySet(ks *KeySet) {
+	r.Lock()
+	r.keys = ks
+	r.Unlock()
+}
+
+// GetKeySet 获取密钥集合
+func (r *Router) GetKeySet() *KeySet {
+	r.RLock()
+	defer r.RUnlock()
+	return r.keys
+}
+
+// ServeJWKS 在 path 上以 JWKS 格式下发公钥，该路由不需要授权
+func (r *Router) ServeJWKS(path string) {
+	r.Lock()
+	r.jwksPath = path
+	r.Unlock()
+}
+
+// InitErrorMsg 初始化自定义错误码
+func (r *Router) InitErrorMsg(msgMap map[int]string) {
+	r.Lock()
+	for no, msg := range msgMap {
+		r.errMsg[no] = msg
+	}
+	r.Unlock()
+}
+
+// GetErrorMsg 获取错误码对应的信息
+func (r *Router) GetErrorMsg(code int) string {
+	r.RLock()
+	defer r.RUnlock()
+	return r.errMsg[code]
+}
+
+// SetCORS 设置跨域配置，BaseRoute.CORS 可以覆盖分组或路由的配置
+func (r *Router) SetCORS(opts *CORSOptions) {
+	r.Lock()
+	r.cors = opts
+	r.Unlock()
+}
+
+// Use 添加全局中间件，作用于之后通过 Handler 创建的路由
+func (r *Router) Use(middlewares ...gin.HandlerFunc) {
+	r.Lock()
+	r.middlewares = append(r.middlewares, middlewares...)
+	r.Unlock()
+}
+
+// Handler 获取路由
+func (r *Router) Handler(routeConf []*BaseRoute, isDebug bool) http.Handler {
+	if !isDebug {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	engine := gin.New()
+	engine.Use(func(c *gin.Context) {
+		c.Set(keyRouter, r)
+	}, requestIDMiddleware)
+	r.RLock()
+	if r.accessLog != nil {
+		engine.Use(accessLogMiddleware(r.accessLog))
+	}
+	engine.Use(recoveryMiddleware)
+	engine.Use(r.middlewares...)
+	opts := r.cors
+	defaultAuth := r.defaultAuth
+	if r.jwksPath != "" && r.keys != nil {
+		engine.GET(r.jwksPath, gin.WrapH(r.keys))
+	}
+	r.RUnlock()
+
+	// 跨域请求
+	ch := newCORSHandler(opts, engine)
+	scope := &routeScope{
+		auth:          defaultAuth,
+		authenticator: r.getAuthenticator(),
+		cors:          ch,
+	}
+	for _, rc := range routeConf {
+		r.createRouteHandler(rc, &engine.RouterGroup, scope)
+	}
+	r.serveOpenAPI(engine, routeConf)
+
+	return ch
+}
+
+// routeScope 分组传递给子路由的配置
+type routeScope struct {
+	role          int
+	timeout       time.Duration
+	auth          AuthMode
+	authenticator Authenticator
+	handlers      []gin.HandlerFunc
+	cors          *corsHandler
+	needClaims    bool // 路由或上级分组设置了 Permissions 或 Owner
+}
+
+// authMode 实际使用的授权方式。需要角色、权限或所有者检查的路由必须授权，
+// 不能因为分组公开而跳过检查
+func (s *routeScope) authMode() AuthMode {
+	if s.auth == AuthNone && (s.role > 0 || s.needClaims) {
+		return AuthOptional
+	}
+	return s.auth
+}
+
+// secured 路由是否需要 token，用于生成文档
+func (s *routeScope) secured() bool {
+	return s.authenticator != nil && (s.role > 0 || s.needClaims || s.auth == AuthRequired)
+}
+
+func (r *Router) createRouteHandler(rConf *BaseRoute, g *gin.RouterGroup, parent *routeScope) {
+	rc := *rConf
+	scope := *parent
+	if rc.Role > 0 {
+		scope.role = rc.Role
+	}
+	if rc.Timeout > 0 {
+		scope.timeout = rc.Timeout
+	}
+	if rc.Auth != AuthInherit {
+		scope.auth = rc.Auth
+	}
+	if rc.Authenticator != nil {
+		scope.authenticator = rc.Authenticator
+	}
+	if len(rc.Permissions) > 0 || rc.Owner != nil {
+		scope.needClaims = true
+	}
+	if rc.CORS != nil {
+		scope.cors.add(path.Join(g.BasePath(), rc.Path), len(rc.Child) == 0, rc.CORS)
+	}
+	if rc.RateLimit != nil || len(rc.Permissions) > 0 || rc.Owner != nil || len(rc.Middlewares) > 0 || rc.Cache != nil {
+		scope.handlers = append([]gin.HandlerFunc{}, scope.handlers...)
+	}
+	if rc.RateLimit != nil {
+		scope.handlers = append(scope.handlers, RateLimitMiddleware(rc.Method+" "+path.Join(g.BasePath(), rc.Path), rc.RateLimit))
+	}
+	if len(rc.Permissions) > 0 {
+		scope.handlers = append(scope.handlers, RequirePermissions(rc.PermissionMode, rc.Permissions...))
+	}
+	if rc.Owner != nil {
+		scope.handlers = append(scope.handlers, RequireOwner(rc.Owner))
+	}
+	if len(rc.Middlewares) > 0 {
+		scope.handlers = append(scope.handlers, rc.Middlewares...)
+	}
+	if rc.Cache != nil {
+		scope.handlers = append(scope.handlers, CacheMiddleware(rc.Cache))
+	}
+	// group
+	if len(rc.Child) > 0 {
+		gg := g.Group(rc.Path)
+		for _, rr := range rc.Child {
+			r.createRouteHandler(rr, gg, &scope)
+		}
+	} else {
+		hs := []gin.HandlerFunc{}
+		handler := rc.Handler
+		if scope.timeout > 0 {
+			handler = WithTimeout(scope.timeout, handler)
+		}
+		h := func(c *gin.Context) {
+			handler(&Context{Context: c, router: r})
+		}
+		if scope.role > 0 {
+			hs = append(hs, getRoleMiddleware(scope.role))
+		}
+		mode := scope.authMode()
+		if scope.authenticator != nil && mode != AuthNone {
+			hs = append(hs, r.authMiddleware(scope.authenticator, mode))
+		}
+		// 自定义中间件
+		if len(scope.handlers) > 0 {
+			hs = append(hs, scope.handlers...)
+		}
+		hs = append(hs, h)
+		g.Handle(rc.Method, rc.Path, hs...)
+	}
+}
+
+// getRouter 获取处理当前请求的路由，不在 Router 中时使用默认路由
+func getRouter(c *gin.Context) *Router {
+	if v, ok := c.Get(keyRouter); ok {
+		return v.(*Router)
+	}
+	return defaultRouter
+}
@@ -0,0 +1,877 @@
+package route
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skiplee85/common/tenant"
+	"github.com/ugorji/go/codec"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func init() {
+	gin.DefaultWriter = ioutil.Discard
+}
+
+func doRequest(h http.Handler, method, path string, header map[string]string) (*httptest.ResponseRecorder, *BaseResponse) {
+	req := httptest.NewRequest(method, path, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	resp := &BaseResponse{}
+	json.Unmarshal(w.Body.Bytes(), resp)
+	return w, resp
+}
+
+func TestRouterIsolation(t *testing.T) {
+	routes := []*BaseRoute{
+		{Method: "GET", Path: "/err", Handler: func(c *Context) { c.SendError(2000) }},
+		{Method: "GET", Path: "/me", Role: 1, Handler: func(c *Context) { c.Send(c.GetClaims().UserID) }},
+	}
+	public := NewRouter("public-secret")
+	public.InitErrorMsg(map[int]string{2000: "public"})
+	admin := NewRouter("admin-secret")
+	admin.InitErrorMsg(map[int]string{2000: "admin"})
+	ph := public.Handler(routes, false)
+	ah := admin.Handler(routes, false)
+
+	_, token, _ := public.GenJwtToken(7, 1, 60)
+	_, adminToken, _ := admin.GenJwtToken(7, 1, 60)
+	if _, resp := doRequest(ph, "GET", "/err", map[string]string{"Authorization": token}); resp.Msg != "public" {
+		t.Fatalf("public msg = %q", resp.Msg)
+	}
+	if _, resp := doRequest(ah, "GET", "/err", map[string]string{"Authorization": adminToken}); resp.Msg != "admin" {
+		t.Fatalf("admin msg = %q", resp.Msg)
+	}
+
+	if _, resp := doRequest(ph, "GET", "/me", map[string]string{"Authorization": token}); resp.Code != CodeOk {
+		t.Fatalf("public token on public router: code = %d", resp.Code)
+	}
+	if _, resp := doRequest(ah, "GET", "/me", map[string]string{"Authorization": token}); resp.Code == CodeOk {
+		t.Fatal("public token accepted by admin router")
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	r := NewRouter("secret")
+	r.SetRevocationStore(NewMemoryRevocationStore())
+	h := r.Handler([]*BaseRoute{
+		{Method: "GET", Path: "/me", Role: 1, Handler: func(c *Context) { c.Send(c.GetClaims().UserID) }},
+	}, false)
+
+	pair, err := r.IssueTokenPair(&UserClaims{UserID: 1, Role: 1}, 60, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, resp := doRequest(h, "GET", "/me", map[string]string{"Authorization": pair.RefreshToken}); resp.Code == CodeOk {
+		t.Fatal("refresh token accepted as access token")
+	}
+	next, err := r.RefreshToken(pair.RefreshToken, 60, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.RefreshToken(pair.RefreshToken, 60, 600); err != ErrRefreshTokenReused {
+		t.Fatalf("reuse err = %v", err)
+	}
+	// 重复使用后整个 token 族失效
+	if _, err := r.RefreshToken(next.RefreshToken, 60, 600); err != ErrRefreshTokenReused {
+		t.Fatalf("family err = %v", err)
+	}
+
+	claims := &UserClaims{UserID: 2, Role: 1}
+	token, _ := r.GenJwtTokenWithClaims(claims, 60)
+	if _, resp := doRequest(h, "GET", "/me", map[string]string{"Authorization": token}); resp.Code != CodeOk {
+		t.Fatalf("code = %d", resp.Code)
+	}
+	if err := r.RevokeToken(claims); err != nil {
+		t.Fatal(err)
+	}
+	if _, resp := doRequest(h, "GET", "/me", map[string]string{"Authorization": token}); resp.Code == CodeOk {
+		t.Fatal("revoked token accepted")
+	}
+	// 没有 jti 的 token 无法吊销，不能报告成功
+	if err := r.RevokeToken(&UserClaims{UserID: 3}); err != ErrNoTokenID {
+		t.Fatalf("revoke without id err = %v", err)
+	}
+}
+
+func TestCheckPermissions(t *testing.T) {
+	granted := []string{"orders:*", "users:read"}
+	cases := []struct {
+		mode  PermissionMode
+		perms []string
+		want  bool
+	}{
+		{PermissionAll, []string{"orders:write", "users:read"}, true},
+		{PermissionAll, []string{"orders:write", "users:write"}, false},
+		{PermissionAny, []string{"users:write", "orders:read"}, true},
+		{PermissionAny, []string{"users:write"}, false},
+	}
+	for _, cs := range cases {
+		if got := checkPermissions(granted, cs.mode, cs.perms); got != cs.want {
+			t.Errorf("checkPermissions(%v, %v) = %v", cs.mode, cs.perms, got)
+		}
+	}
+}
+
+func TestAuthenticators(t *testing.T) {
+	r := NewRouter("secret")
+	keys := NewAPIKeyAuthenticator("")
+	keys.AddKey("k1", &UserClaims{UserID: 9, Role: 1})
+	r.SetAuthenticator(ChainAuthenticators(BearerAuthenticator(), keys))
+	uid := func(c *Context) {
+		if claims := c.GetClaims(); claims != nil {
+			c.Send(claims.UserID)
+			return
+		}
+		c.Send(0)
+	}
+	h := r.Handler([]*BaseRoute{
+		{Method: "GET", Path: "/public", Auth: AuthNone, Handler: uid},
+		{Method: "GET", Path: "/optional", Auth: AuthOptional, Handler: uid},
+		{Method: "GET", Path: "/me", Role: 1, Handler: uid},
+		{Path: "/open", Auth: AuthNone, Child: []*BaseRoute{
+			{Method: "GET", Path: "/admin", Role: 9, Handler: uid},
+			{Method: "GET", Path: "/reports", Permissions: []string{"reports:read"}, Handler: uid},
+			{Method: "GET", Path: "/mine", Owner: func(c *Context, claims *UserClaims) bool { return claims.UserID == 7 }, Handler: uid},
+			{Path: "/shared", Permissions: []string{"reports:read"}, Child: []*BaseRoute{
+				{Method: "GET", Path: "/list", Handler: uid},
+			}},
+		}},
+	}, false)
+	r.SetRolePermissions(map[int][]string{9: {"reports:read"}})
+	_, token, _ := r.GenJwtToken(7, 1, 60)
+	_, admin, _ := r.GenJwtToken(8, 9, 60)
+
+	cases := []struct {
+		path   string
+		header map[string]string
+		code   int
+		data   float64
+	}{
+		{"/public", nil, CodeOk, 0},
+		{"/optional", nil, CodeOk, 0},
+		{"/optional", map[string]string{"Authorization": "Bearer " + token}, CodeOk, 7},
+		{"/me", nil, 401, 0},
+		{"/me", map[string]string{"Authorization": "Bearer " + token}, CodeOk, 7},
+		{"/me", map[string]string{"Authorization": token}, CodeOk, 7},
+		{"/me", map[string]string{"X-API-Key": "k1"}, CodeOk, 9},
+		{"/me", map[string]string{"X-API-Key": "k2"}, 401, 0},
+		{"/open/admin", nil, 401, 0},
+		{"/open/admin", map[string]string{"Authorization": "Bearer " + token}, 403, 0},
+		{"/open/admin", map[string]string{"Authorization": "Bearer " + admin}, CodeOk, 8},
+		// 公开分组下需要权限或所有者检查的路由同样读取 token
+		{"/open/reports", nil, 401, 0},
+		{"/open/reports", map[string]string{"Authorization": "Bearer " + token}, 403, 0},
+		{"/open/reports", map[string]string{"Authorization": "Bearer " + admin}, CodeOk, 8},
+		{"/open/shared/list", map[string]string{"Authorization": "Bearer " + admin}, CodeOk, 8},
+		{"/open/mine", map[string]string{"Authorization": "Bearer " + token}, CodeOk, 7},
+		{"/open/mine", map[string]string{"Authorization": "Bearer " + admin}, 403, 0},
+	}
+	for _, cs := range cases {
+		_, resp := doRequest(h, "GET", cs.path, cs.header)
+		if resp.Code != cs.code {
+			t.Errorf("%s %v: code = %d, want %d", cs.path, cs.header, resp.Code, cs.code)
+			continue
+		}
+		if data, _ := resp.Data.(float64); cs.code == CodeOk && data != cs.data {
+			t.Errorf("%s %v: data = %v, want %v", cs.path, cs.header, resp.Data, cs.data)
+		}
+	}
+}
+
+func TestTenantContext(t *testing.T) {
+	r := NewRouter("secret")
+	h := r.Handler([]*BaseRoute{
+		{Method: "GET", Path: "/tenant", Handler: func(c *Context) {
+			id, _ := tenant.FromContext(c.Request.Context())
+			c.Send(id + "/" + c.GetTenantID())
+		}},
+	}, false)
+	token, _ := r.GenJwtTokenWithClaims(&UserClaims{UserID: 1, TenantID: "acme"}, 60)
+	if _, resp := doRequest(h, "GET", "/tenant", map[string]string{"Authorization": token}); resp.Data != "acme/acme" {
+		t.Fatalf("tenant = %v", resp.Data)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	r := NewRouter("")
+	r.SetCORS(&CORSOptions{AllowedOrigins: []string{"https://*.example.com"}, AllowedMethods: []string{"GET"}})
+	ok := func(c *Context) { c.Send(nil) }
+	h := r.Handler([]*BaseRoute{
+		{Method: "GET", Path: "/api", Handler: ok},
+		{Path: "/open", CORS: &CORSOptions{AllowedMethods: []string{"GET"}}, Child: []*BaseRoute{
+			{Method: "GET", Path: "/:id", Handler: ok},
+		}},
+	}, false)
+
+	cases := []struct {
+		path, origin, want string
+	}{
+		{"/api", "https://a.example.com", "https://a.example.com"},
+		{"/api", "https://evil.com", ""},
+		{"/open/1", "https://evil.com", "*"},
+	}
+	for _, cs := range cases {
+		w, _ := doRequest(h, "GET", cs.path, map[string]string{"Origin": cs.origin})
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != cs.want {
+			t.Errorf("%s %s: allow origin = %q, want %q", cs.path, cs.origin, got, cs.want)
+		}
+	}
+
+	// 默认配置允许所有来源，但不允许携带 cookie
+	h = NewRouter("").Handler([]*BaseRoute{{Method: "GET", Path: "/api", Handler: ok}}, false)
+	w, _ := doRequest(h, "GET", "/api", map[string]string{"Origin": "https://evil.com"})
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" || w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Fatalf("default cors headers = %v", w.Header())
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	r := NewRouter("")
+	h := r.Handler([]*BaseRoute{
+		{Method: "POST", Path: "/login", RateLimit: &RateLimit{Limit: 2, Period: time.Minute}, Handler: func(c *Context) { c.Send(nil) }},
+	}, false)
+	for i := 0; i < 2; i++ {
+		if w, _ := doRequest(h, "POST", "/login", nil); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Remaining") != strconv.Itoa(1-i) {
+			t.Fatalf("request %d: status = %d, remaining = %s", i, w.Code, w.Header().Get("X-RateLimit-Remaining"))
+		}
+	}
+	w, resp := doRequest(h, "POST", "/login", nil)
+	if w.Code != http.StatusTooManyRequests || resp.Code != CodeErrorTooManyRequests || w.Header().Get("Retry-After") != "30" {
+		t.Fatalf("status = %d, code = %d, retry after = %s", w.Code, resp.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestRateLimitKeyAndValidation(t *testing.T) {
+	r := NewRouter("")
+	routes := []*BaseRoute{
+		{Method: "POST", Path: "/login", Auth: AuthNone, RateLimit: &RateLimit{Limit: 1, Period: time.Minute}, Handler: func(c *Context) { c.Send(nil) }},
+	}
+	h := r.Handler(routes, false)
+	// 没有可信代理时不信任 X-Forwarded-For
+	doRequest(h, "POST", "/login", map[string]string{"X-Forwarded-For": "1.1.1.1"})
+	if _, resp := doRequest(h, "POST", "/login", map[string]string{"X-Forwarded-For": "2.2.2.2"}); resp.Code != CodeErrorTooManyRequests {
+		t.Fatalf("spoofed forwarded for bypassed limiter, code = %d", resp.Code)
+	}
+
+	for _, rl := range []*RateLimit{{Limit: 1}, {Period: time.Minute}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("rate limit %+v should be rejected", rl)
+				}
+			}()
+			NewRouter("").Handler([]*BaseRoute{{Method: "GET", Path: "/", RateLimit: rl, Handler: func(c *Context) {}}}, false)
+		}()
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	r := NewRouter("")
+	r.SetAccessLog(buf)
+	h := r.Handler([]*BaseRoute{
+		{Method: "GET", Path: "/users/:id", Handler: func(c *Context) { c.SendError(2001) }},
+	}, false)
+	w, _ := doRequest(h, "GET", "/users/3", map[string]string{HeaderRequestID: "req-1"})
+	if w.Header().Get(HeaderRequestID) != "req-1" {
+		t.Fatalf("request id = %q", w.Header().Get(HeaderRequestID))
+	}
+	entry := &AccessLog{}
+	if err := json.Unmarshal(buf.Bytes(), entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.RequestID != "req-1" || entry.Route != "/users/:id" || entry.Code != 2001 || entry.Status != http.StatusBadRequest {
+		t.Fatalf("entry = %+v", entry)
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	type args struct {
+		ID   int    `uri:"id"`
+		Name string `json:"name" form:"nick" binding:"required,max=20"`
+		Age  int    `json:"age" binding:"min=0"`
+	}
+	type query struct {
+		Pagination
+		ID     int    `uri:"id"`
+		Status string `form:"status" binding:"oneof=new done"`
+	}
+	r := NewRouter("secret")
+	spec := r.OpenAPI([]*BaseRoute{
+		{Path: "/users", Role: 1, Child: []*BaseRoute{
+			{Method: "GET", Path: "", Doc: &RouteDoc{Args: query{}, Resp: []args{}}},
+			{Method: "PUT", Path: "/:id", Doc: &RouteDoc{Args: args{}}},
+			{Method: "DELETE", Path: "/:id", Doc: &RouteDoc{Args: struct{ Args args }{}}},
+		}},
+		{Method: "GET", Path: "/ping", Auth: AuthNone},
+		{Path: "/open", Auth: AuthNone, Child: []*BaseRoute{
+			{Method: "GET", Path: "/admin", Role: 1},
+			{Path: "/reports", Permissions: []string{"reports:read"}, Child: []*BaseRoute{
+				{Method: "GET", Path: "/list"},
+			}},
+		}},
+	}, &OpenAPIInfo{Title: "test"})
+	data, _ := json.Marshal(spec)
+	doc := struct {
+		Paths map[string]map[string]struct {
+			Security    []interface{}
+			Parameters  []struct{ Name, In string }
+			RequestBody interface{}
+		}
+		Components struct {
+			Schemas map[string]struct{ Properties map[string]interface{} }
+		}
+	}{}
+	json.Unmarshal(data, &doc)
+
+	list := doc.Paths["/users"]["get"]
+	if len(list.Security) != 1 || len(list.Parameters) != 4 {
+		t.Fatalf("list = %+v", list)
+	}
+	put := doc.Paths["/users/{id}"]["put"]
+	if put.RequestBody == nil || len(put.Parameters) != 1 || put.Parameters[0].In != "path" {
+		t.Fatalf("put = %+v", put)
+	}
+	if ping := doc.Paths["/ping"]["get"]; len(ping.Security) != 0 {
+		t.Fatalf("ping = %+v", ping)
+	}
+	if admin := doc.Paths["/open/admin"]["get"]; len(admin.Security) != 1 {
+		t.Fatalf("role route under AuthNone group = %+v", admin)
+	}
+	if list := doc.Paths["/open/reports/list"]["get"]; len(list.Security) != 1 {
+		t.Fatalf("permission route under AuthNone group = %+v", list)
+	}
+	// uri 字段不出现在 query 和请求体中，同一类型按 json 和 form 分别生成
+	body, form := doc.Components.Schemas["args"], doc.Components.Schemas["args_form"]
+	if len(body.Properties) != 2 || body.Properties["name"] == nil || len(form.Properties) != 2 || form.Properties["nick"] == nil {
+		t.Fatalf("schemas = %+v", doc.Components.Schemas)
+	}
+
+	r.ServeOpenAPI(&OpenAPIInfo{Title: "test", UIPath: "/docs", UIAssets: &SwaggerUIAssets{
+		ScriptURL:       "/static/swagger-ui-bundle.js",
+		ScriptIntegrity: "sha384-abc",
+	}})
+	h := r.Handler([]*BaseRoute{{Method: "GET", Path: "/ping", Auth: AuthNone, Handler: func(c *Context) {}}}, false)
+	w, _ := doRequest(h, "GET", "/docs", nil)
+	page := w.Body.String()
+	if !strings.Contains(page, `src="/static/swagger-ui-bundle.js" integrity="sha384-abc"`) || !strings.Contains(page, "swagger-ui-dist@"+DefaultSwaggerUIVersion+"/swagger-ui.css") {
+		t.Fatalf("page = %s", page)
+	}
+}
+
+type codeError int
+
+func (e codeError) Error() string  { return "code error" }
+func (e codeError) ErrorCode() int { return int(e) }
+
+func TestTypedHandler(t *testing.T) {
+	type getUser struct {
+		ID      int    `uri:"id"`
+		Verbose bool   `form:"verbose"`
+		Name    string `form:"name" binding:"required"`
+	}
+	type user struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	r := NewRouter("")
+	h := r.Handler([]*BaseRoute{
+		TypedRoute("GET", "/users/:id", func(c *Context, req *getUser) (*user, error) {
+			if req.ID == 0 {
+				return nil, codeError(2002)
+			}
+			return &user{ID: req.ID, Name: req.Name}, nil
+		}),
+		TypedRoute("GET", "/users", func(c *Context, req *NoArgs) (*Page[[]user], error) {
+			return &Page[[]user]{List: []user{{ID: 1}}, Pagination: GetDefaultPagination()}, nil
+		}),
+	}, false)
+
+	if _, resp := doRequest(h, "GET", "/users/5?name=a", nil); resp.Code != CodeOk || resp.Data.(map[string]interface{})["id"] != float64(5) {
+		t.Fatalf("resp = %+v", resp)
+	}
+	if _, resp := doRequest(h, "GET", "/users/5", nil); resp.Code != CodeErrorInvalidArguments {
+		t.Fatalf("missing name: code = %d", resp.Code)
+	}
+	if _, resp := doRequest(h, "GET", "/users/0?name=a", nil); resp.Code != 2002 {
+		t.Fatalf("error code = %d", resp.Code)
+	}
+	if _, resp := doRequest(h, "GET", "/users", nil); resp.Pagination == nil || len(resp.Data.([]interface{})) != 1 {
+		t.Fatalf("page = %+v", resp)
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	errNotFound := NewError(2004, "not found")
+	cause := errors.New("db down")
+	wrapped := fmt.Errorf("load: %w", errNotFound.WithCause(cause))
+	if !errors.Is(wrapped, errNotFound) || !errors.Is(wrapped, cause) {
+		t.Fatal("errors.Is should match code and cause")
+	}
+
+	r := NewRouter("")
+	r.SetErrorStatus(StatusRange{Min: 2000, Max: 2999, Status: http.StatusNotFound})
+	h := r.Handler([]*BaseRoute{
+		TypedRoute("GET", "/a", func(c *Context, req *NoArgs) (*NoArgs, error) {
+			return nil, wrapped
+		}),
+		TypedRoute("GET", "/b", func(c *Context, req *NoArgs) (*NoArgs, error) {
+			return nil, cause
+		}),
+	}, false)
+
+	w, resp := doRequest(h, "GET", "/a", nil)
+	if w.Code != http.StatusNotFound || resp.Code != 2004 || resp.Msg != "not found" || strings.Contains(w.Body.String(), "db down") {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	w, resp = doRequest(h, "GET", "/b", nil)
+	if w.Code != http.StatusInternalServerError || resp.Code != CodeErrorInternal || strings.Contains(w.Body.String(), "db down") {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "zh-CN.yaml"), []byte("1000: \"参数错误: {error}\"\n2001: \"余额不足，还差 {amount} 元\"\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "en.json"), []byte(`{"2001": "insufficient balance, {amount} short"}`), 0644)
+	catalog := NewCatalog("zh-CN")
+	if err := catalog.LoadDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if l := catalog.Negotiate("fr;q=0.9, en-US;q=0.8, zh;q=0.5"); l != "en" {
+		t.Fatalf("negotiate = %s", l)
+	}
+
+	r := NewRouter("secret")
+	r.SetCatalog(catalog)
+	h := r.Handler([]*BaseRoute{
+		TypedRoute("GET", "/pay", func(c *Context, req *struct {
+			Amount int `form:"amount" binding:"required"`
+		}) (*NoArgs, error) {
+			return nil, NewError(2001).WithParams(Params{"amount": req.Amount})
+		}),
+	}, false)
+	_, token, _ := r.GenJwtToken(1, 0, 3600)
+	auth := "Bearer " + token
+	en, _ := r.GenJwtTokenWithClaims(&UserClaims{UserID: 1, Locale: "en"}, 3600)
+
+	if _, resp := doRequest(h, "GET", "/pay?amount=3", map[string]string{"Authorization": auth, "Accept-Language": "en-GB"}); resp.Msg != "insufficient balance, 3 short" {
+		t.Fatalf("msg = %s", resp.Msg)
+	}
+	if _, resp := doRequest(h, "GET", "/pay?amount=3", map[string]string{"Authorization": "Bearer " + en, "Accept-Language": "zh"}); resp.Msg != "insufficient balance, 3 short" {
+		t.Fatalf("claims locale msg = %s", resp.Msg)
+	}
+	if _, resp := doRequest(h, "GET", "/pay?amount=3", map[string]string{"Authorization": auth}); resp.Msg != "余额不足，还差 3 元" {
+		t.Fatalf("fallback msg = %s", resp.Msg)
+	}
+	if _, resp := doRequest(h, "GET", "/pay", map[string]string{"Authorization": auth}); !strings.HasPrefix(resp.Msg, "参数错误: ") {
+		t.Fatalf("invalid args msg = %s", resp.Msg)
+	}
+}
+
+func TestFieldErrors(t *testing.T) {
+	if err := RegisterEnum("order_status", "paid", "closed"); err != nil {
+		t.Fatal(err)
+	}
+	if !ValidIDCard("11010519491231002X") || ValidIDCard("110105194912310021") {
+		t.Fatal("id card checksum")
+	}
+	type address struct {
+		City string `json:"city" binding:"required"`
+	}
+	type args struct {
+		Phone   string   `json:"phone" binding:"required,phone"`
+		Status  string   `json:"status" binding:"order_status"`
+		Address *address `json:"address" binding:"required"`
+	}
+	r := NewRouter("")
+	h := r.Handler([]*BaseRoute{
+		TypedRoute("POST", "/orders", func(c *Context, req *args) (*NoArgs, error) {
+			return nil, nil
+		}),
+	}, false)
+
+	req := httptest.NewRequest("POST", "/orders", strings.NewReader(`{"phone":"123","status":"open","address":{}}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	resp := &BaseResponse{}
+	json.Unmarshal(w.Body.Bytes(), resp)
+	want := map[string]string{"phone": "phone", "status": "order_status", "address.city": "required"}
+	if resp.Code != CodeErrorInvalidArguments || len(resp.Errors) != len(want) {
+		t.Fatalf("body = %s", w.Body.String())
+	}
+	for _, fe := range resp.Errors {
+		if want[fe.Field] != fe.Rule || fe.Message == "" {
+			t.Fatalf("field error = %+v", fe)
+		}
+	}
+	if resp.Msg != "phone must be a valid phone number" {
+		t.Fatalf("msg = %s", resp.Msg)
+	}
+}
+
+func TestResponsePolicy(t *testing.T) {
+	routes := []*BaseRoute{
+		{Method: "GET", Path: "/args", Auth: AuthNone, Handler: func(c *Context) {
+			args := &struct {
+				ID int `form:"id" binding:"required"`
+			}{}
+			if c.ValidaArgs(args) == nil {
+				c.SendError(CodeErrorRequest)
+			}
+		}},
+		{Method: "GET", Path: "/me", Handler: func(c *Context) { c.Send(nil) }},
+	}
+	cases := []struct {
+		policy ResponsePolicy
+		path   string
+		header map[string]string
+		status int
+	}{
+		{PolicyLegacy, "/args", nil, http.StatusOK},
+		{PolicyLegacy, "/args?id=1", nil, http.StatusInternalServerError},
+		{PolicyLegacy, "/me", map[string]string{"Authorization": "Bearer bad"}, http.StatusOK},
+		{PolicyRESTful, "/args", nil, http.StatusBadRequest},
+		{PolicyRESTful, "/args?id=1", nil, http.StatusBadRequest},
+		{PolicyRESTful, "/me", map[string]string{"Authorization": "Bearer bad"}, http.StatusUnauthorized},
+		{PolicyAlwaysOK, "/args?id=1", nil, http.StatusOK},
+		{PolicyAlwaysOK, "/me", nil, http.StatusOK},
+	}
+	for _, tc := range cases {
+		r := NewRouter("secret")
+		r.SetResponsePolicy(tc.policy)
+		h := r.Handler(routes, false)
+		if w, resp := doRequest(h, "GET", tc.path, tc.header); w.Code != tc.status || resp.Code == CodeOk {
+			t.Fatalf("policy %d %s: status = %d, code = %d", tc.policy, tc.path, w.Code, resp.Code)
+		}
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	type args struct {
+		Name string `json:"name" binding:"required"`
+		Age  int    `json:"age"`
+	}
+	r := NewRouter("")
+	h := r.Handler([]*BaseRoute{
+		TypedRoute("POST", "/echo", func(c *Context, req *args) (*args, error) {
+			return req, nil
+		}),
+	}, false)
+	post := func(contentType string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/echo", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Accept", contentType)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	mh := &codec.MsgpackHandle{}
+	var body []byte
+	codec.NewEncoderBytes(&body, mh).Encode(map[string]interface{}{"name": "a", "age": 3})
+	w := post("application/x-msgpack", body)
+	resp := map[string]interface{}{}
+	if err := codec.NewDecoderBytes(w.Body.Bytes(), mh).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := resp["data"].(map[interface{}]interface{}); !ok || string(data["name"].([]byte)) != "a" {
+		t.Fatalf("msgpack resp = %v", resp)
+	}
+
+	in, _ := structpb.NewStruct(map[string]interface{}{"age": 3})
+	body, _ = proto.Marshal(in)
+	w = post("application/x-protobuf", body)
+	out := &structpb.Struct{}
+	if err := proto.Unmarshal(w.Body.Bytes(), out); err != nil {
+		t.Fatal(err)
+	}
+	if code := out.Fields["code"].GetNumberValue(); code != CodeErrorInvalidArguments {
+		t.Fatalf("protobuf resp = %v", out)
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	r := NewRouter("")
+	h := r.Handler([]*BaseRoute{
+		{Method: "POST", Path: "/pay", Middlewares: []gin.HandlerFunc{IdempotencyMiddleware(&Idempotency{Required: true})}, Handler: func(c *Context) {
+			n := atomic.AddInt32(&calls, 1)
+			if c.Query("wait") != "" {
+				<-release
+			}
+			if c.Query("fail") != "" {
+				c.SendError(CodeErrorInternal)
+				return
+			}
+			c.Send(n)
+		}},
+	}, false)
+
+	if _, resp := doRequest(h, "POST", "/pay", nil); resp.Code != CodeErrorRequest {
+		t.Fatalf("missing key: code = %d", resp.Code)
+	}
+	w1, _ := doRequest(h, "POST", "/pay", map[string]string{HeaderIdempotencyKey: "k1"})
+	w2, _ := doRequest(h, "POST", "/pay", map[string]string{HeaderIdempotencyKey: "k1"})
+	if calls != 1 || w2.Body.String() != w1.Body.String() || w2.Header().Get(HeaderIdempotentReplayed) != "true" {
+		t.Fatalf("calls = %d, replay = %s", calls, w2.Body.String())
+	}
+
+	doRequest(h, "POST", "/pay?fail=1", map[string]string{HeaderIdempotencyKey: "k2"})
+	doRequest(h, "POST", "/pay?fail=1", map[string]string{HeaderIdempotencyKey: "k2"})
+	if calls != 3 {
+		t.Fatalf("failed request should not be saved, calls = %d", calls)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		doRequest(h, "POST", "/pay?wait=1", map[string]string{HeaderIdempotencyKey: "k3"})
+		close(done)
+	}()
+	for atomic.LoadInt32(&calls) != 4 {
+		time.Sleep(time.Millisecond)
+	}
+	if w, resp := doRequest(h, "POST", "/pay", map[string]string{HeaderIdempotencyKey: "k3"}); w.Code != http.StatusConflict || resp.Code != CodeErrorConflict {
+		t.Fatalf("in flight: status = %d, code = %d", w.Code, resp.Code)
+	}
+	close(release)
+	<-done
+
+	post := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/pay", strings.NewReader(body))
+		req.Header.Set(HeaderIdempotencyKey, key)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	post("k4", `{"amount":1}`)
+	if w := post("k4", `{"amount":1}`); w.Header().Get(HeaderIdempotentReplayed) != "true" {
+		t.Fatalf("same body should replay: %s", w.Body.String())
+	}
+	if w := post("k4", `{"amount":2}`); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("different body: status = %d", w.Code)
+	}
+}
+
+func TestIdempotencyAlwaysOK(t *testing.T) {
+	var calls int32
+	r := NewRouter("")
+	r.SetResponsePolicy(PolicyAlwaysOK)
+	h := r.Handler([]*BaseRoute{
+		{Method: "POST", Path: "/pay", Middlewares: []gin.HandlerFunc{IdempotencyMiddleware(&Idempotency{})}, Handler: func(c *Context) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				c.SendError(CodeErrorInternal)
+				return
+			}
+			c.Send("ok")
+		}},
+	}, false)
+	header := map[string]string{HeaderIdempotencyKey: "k"}
+	if w, resp := doRequest(h, "POST", "/pay", header); w.Code != http.StatusOK || resp.Code != CodeErrorInternal {
+		t.Fatalf("first: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	// 业务码为 5xx 的响应不保存，重试重新处理
+	if w, resp := doRequest(h, "POST", "/pay", header); w.Header().Get(HeaderIdempotentReplayed) != "" || resp.Data != "ok" {
+		t.Fatalf("retry: body = %s", w.Body.String())
+	}
+	if calls != 2 {
+		t.Fatalf("calls = %d", calls)
+	}
+}
+
+func TestIdempotencyTimeout(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	r := NewRouter("")
+	h := r.Handler([]*BaseRoute{
+		{Method: "POST", Path: "/pay", Timeout: 20 * time.Millisecond, Middlewares: []gin.HandlerFunc{IdempotencyMiddleware(&Idempotency{})}, Handler: func(c *Context) {
+			n := atomic.AddInt32(&calls, 1)
+			<-release
+			c.Send(n)
+		}},
+	}, false)
+	header := map[string]string{HeaderIdempotencyKey: "k"}
+	if w, _ := doRequest(h, "POST", "/pay", header); w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("first: status = %d", w.Code)
+	}
+	// 超时后处理函数仍在运行，key 不能被释放
+	if w, resp := doRequest(h, "POST", "/pay", header); w.Code != http.StatusConflict || resp.Code != CodeErrorConflict {
+		t.Fatalf("retry while running: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for {
+		w, resp := doRequest(h, "POST", "/pay", header)
+		if w.Code != http.StatusConflict {
+			if w.Header().Get(HeaderIdempotentReplayed) != "true" || resp.Data != float64(1) {
+				t.Fatalf("retry after finish: status = %d, body = %s", w.Code, w.Body.String())
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("key still held after handler finished")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if calls != 1 {
+		t.Fatalf("calls = %d", calls)
+	}
+}
+
+type failingIdempotencyStore struct{}
+
+func (failingIdempotencyStore) Begin(string, time.Duration) (bool, *IdempotentResponse, error) {
+	return false, nil, errors.New("store down")
+}
+func (failingIdempotencyStore) Complete(string, *IdempotentResponse, time.Duration) error { return nil }
+func (failingIdempotencyStore) Release(string) error                                      { return nil }
+
+func TestIdempotencyStoreError(t *testing.T) {
+	r := NewRouter("")
+	h := r.Handler([]*BaseRoute{
+		{Method: "POST", Path: "/closed", Middlewares: []gin.HandlerFunc{IdempotencyMiddleware(&Idempotency{Store: failingIdempotencyStore{}})}, Handler: func(c *Context) { c.Send(1) }},
+		{Method: "POST", Path: "/open", Middlewares: []gin.HandlerFunc{IdempotencyMiddleware(&Idempotency{Store: failingIdempotencyStore{}, FailOpen: true})}, Handler: func(c *Context) { c.Send(1) }},
+	}, false)
+	header := map[string]string{HeaderIdempotencyKey: "k"}
+	if w, resp := doRequest(h, "POST", "/closed", header); w.Code != http.StatusServiceUnavailable || resp.Code != CodeErrorUnavailable {
+		t.Fatalf("fail closed: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if w, resp := doRequest(h, "POST", "/open", header); w.Code != http.StatusOK || resp.Code != CodeOk {
+		t.Fatalf("fail open: status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	var calls int32
+	r := NewRouter("")
+	h := r.Handler([]*BaseRoute{
+		{Method: "GET", Path: "/orders/:id", Cache: &ResponseCache{
+			TTL:     time.Minute,
+			TagFunc: func(c *Context) []string { return []string{"order:" + c.Param("id")} },
+		}, Handler: func(c *Context) {
+			c.Send(atomic.AddInt32(&calls, 1))
+		}},
+		{Method: "POST", Path: "/orders/:id", Handler: func(c *Context) {
+			c.InvalidateCache("order:" + c.Param("id"))
+			c.Send(nil)
+		}},
+	}, false)
+
+	w1, _ := doRequest(h, "GET", "/orders/1?a=1", nil)
+	etag := w1.Header().Get("ETag")
+	w2, _ := doRequest(h, "GET", "/orders/1?a=1", nil)
+	if calls != 1 || etag == "" || w2.Body.String() != w1.Body.String() || w2.Header().Get("ETag") != etag {
+		t.Fatalf("calls = %d, etag = %s", calls, etag)
+	}
+	if w, _ := doRequest(h, "GET", "/orders/1?a=1", map[string]string{"If-None-Match": etag}); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("status = %d", w.Code)
+	}
+	doRequest(h, "GET", "/orders/1?a=2", nil)
+	if calls != 2 {
+		t.Fatalf("vary by query, calls = %d", calls)
+	}
+	doRequest(h, "POST", "/orders/1", nil)
+	if w, _ := doRequest(h, "GET", "/orders/1?a=1", map[string]string{"If-None-Match": etag}); calls != 3 || w.Code != http.StatusOK {
+		t.Fatalf("after invalidate: calls = %d, status = %d", calls, w.Code)
+	}
+}
+
+func TestResponseCacheVaryUser(t *testing.T) {
+	r := NewRouter("secret")
+	h := r.Handler([]*BaseRoute{
+		{Method: "GET", Path: "/me", Cache: &ResponseCache{TTL: time.Minute}, Handler: func(c *Context) {
+			c.Send(c.GetClaims().UserID)
+		}},
+		{Method: "GET", Path: "/role", Cache: &ResponseCache{TTL: time.Minute, VaryBy: VaryRole}, Handler: func(c *Context) {
+			c.Send(c.GetClaims().UserID)
+		}},
+	}, false)
+	_, a, _ := r.GenJwtToken(7, 1, 60)
+	_, b, _ := r.GenJwtToken(8, 1, 60)
+	get := func(path, token string) interface{} {
+		_, resp := doRequest(h, "GET", path, map[string]string{"Authorization": token})
+		return resp.Data
+	}
+	// 授权路由默认按用户区分
+	if get("/me", a) != float64(7) || get("/me", b) != float64(8) {
+		t.Fatal("authenticated response shared between users")
+	}
+	// 明确按角色区分时同角色共享
+	if get("/role", a) != float64(7) || get("/role", b) != float64(7) {
+		t.Fatal("VaryRole should share the response within a role")
+	}
+}
+
+func panicHandler(c *Context) {
+	panic("boom")
+}
+
+func TestTimeoutAndRecovery(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	r := NewRouter("")
+	h := r.Handler([]*BaseRoute{
+		{Path: "/api", Timeout: 20 * time.Millisecond, Child: []*BaseRoute{
+			{Method: "GET", Path: "/slow", Handler: func(c *Context) {
+				<-c.Request.Context().Done()
+				c.Send("late")
+			}},
+			{Method: "GET", Path: "/fast", Handler: func(c *Context) {
+				c.Send("ok")
+			}},
+			{Method: "GET", Path: "/stuck", Handler: func(c *Context) {
+				time.Sleep(300 * time.Millisecond)
+				c.Send("late")
+			}},
+			{Method: "GET", Path: "/panic", Handler: panicHandler},
+		}},
+		{Method: "POST", Path: "/pay", Auth: AuthNone, Middlewares: []gin.HandlerFunc{IdempotencyMiddleware(&Idempotency{})}, Handler: panicHandler},
+	}, false)
+
+	if w, resp := doRequest(h, "GET", "/api/slow", nil); w.Code != http.StatusGatewayTimeout || resp.Code != CodeErrorTimeout || resp.Data != nil {
+		t.Fatalf("slow: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	start := time.Now()
+	if w, resp := doRequest(h, "GET", "/api/stuck", nil); w.Code != http.StatusGatewayTimeout || resp.Code != CodeErrorTimeout || time.Since(start) > 200*time.Millisecond {
+		t.Fatalf("stuck: status = %d, elapsed = %v", w.Code, time.Since(start))
+	}
+	if w, resp := doRequest(h, "GET", "/api/fast", nil); w.Code != http.StatusOK || resp.Data != "ok" {
+		t.Fatalf("fast: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if w, resp := doRequest(h, "GET", "/api/panic", map[string]string{HeaderRequestID: "req-p"}); w.Code != http.StatusInternalServerError || resp.Code != CodeErrorInternal || w.Header().Get(HeaderRequestID) != "req-p" {
+		t.Fatalf("panic: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(logs.String(), "route.panicHandler") {
+		t.Fatalf("stack should contain the panicking handler:\n%s", logs.String())
+	}
+	logs.Reset()
+	if w, resp := doRequest(h, "POST", "/pay", map[string]string{HeaderIdempotencyKey: "k"}); w.Code != http.StatusInternalServerError || resp.Code != CodeErrorInternal {
+		t.Fatalf("idempotent panic: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(logs.String(), "route.panicHandler") {
+		t.Fatalf("stack should contain the panicking handler:\n%s", logs.String())
+	}
+}
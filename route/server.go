@@ -0,0 +1,253 @@
+package route
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/skiplee85/common/mongodb"
+)
+
+// HealthChecker 就绪检查，返回 error 表示依赖不可用
+type HealthChecker func(ctx context.Context) error
+
+// MongoChecker mongo 连接检查
+func MongoChecker(c *mongodb.DialContext) HealthChecker {
+	return singlePing(c.Ping)
+}
+
+// pingCall 正在进行的 ping
+type pingCall struct {
+	done chan struct{}
+	err  error
+}
+
+// singlePing ping 不支持 context，连接池耗尽或 mongo 不可用时会一直阻塞。
+// 同时最多只有一个 ping，之后的检查等待它的结果，不会每次检查都堆积一个 goroutine
+func singlePing(ping func() error) HealthChecker {
+	var (
+		mu      sync.Mutex
+		pending *pingCall
+	)
+	return func(ctx context.Context) error {
+		mu.Lock()
+		call := pending
+		if call == nil {
+			call = &pingCall{done: make(chan struct{})}
+			pending = call
+			go func() {
+				call.err = ping()
+				mu.Lock()
+				pending = nil
+				mu.Unlock()
+				close(call.done)
+			}()
+		}
+		mu.Unlock()
+		select {
+		case <-call.done:
+			return call.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+type namedChecker struct {
+	name string
+	fn   HealthChecker
+}
+
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// Server 管理 http 服务的生命周期：监听、健康检查、收到 SIGINT/SIGTERM 后优雅退出
+type Server struct {
+	HTTP          *http.Server  // 可以设置读写超时等参数，不要修改 Handler
+	CertFile      string        // 证书，和 KeyFile 同时设置时使用 TLS
+	KeyFile       string        // 私钥
+	HealthPath    string        // 存活检查，默认 /healthz
+	ReadyPath     string        // 就绪检查，默认 /readyz
+	CheckTimeout  time.Duration // 就绪检查超时，默认 5 秒
+	ShutdownDelay time.Duration // 退出时先标记未就绪，等待负载均衡摘除后再关闭监听
+	DrainTimeout  time.Duration // 等待处理中请求完成的时间，默认 30 秒
+
+	handler  http.Handler
+	mu       sync.Mutex
+	checkers []namedChecker
+	hooks    []shutdownHook
+	stopping int32
+}
+
+// NewServer 创建服务，handler 通常为 Router.Handler 的返回值
+func NewServer(addr string, handler http.Handler) *Server {
+	s := &Server{
+		HealthPath:   "/healthz",
+		ReadyPath:    "/readyz",
+		CheckTimeout: 5 * time.Second,
+		DrainTimeout: 30 * time.Second,
+		handler:      handler,
+	}
+	s.HTTP = &http.Server{
+		Addr:    addr,
+		Handler: s,
+	}
+	return s
+}
+
+// AddChecker 添加就绪检查
+func (s *Server) AddChecker(name string, fn HealthChecker) {
+	s.mu.Lock()
+	s.checkers = append(s.checkers, namedChecker{name, fn})
+	s.mu.Unlock()
+}
+
+// OnShutdown 添加退出时执行的函数，在停止接收请求后按添加顺序执行
+func (s *Server) OnShutdown(name string, fn func(ctx context.Context) error) {
+	s.mu.Lock()
+	s.hooks = append(s.hooks, shutdownHook{name, fn})
+	s.mu.Unlock()
+}
+
+// ServeHTTP 处理健康检查，其他请求交给 handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case s.HealthPath:
+		writeHealth(w, http.StatusOK, nil)
+	case s.ReadyPath:
+		s.serveReady(w, r)
+	default:
+		s.handler.ServeHTTP(w, r)
+	}
+}
+
+func (s *Server) serveReady(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.stopping) == 1 {
+		writeHealth(w, http.StatusServiceUnavailable, map[string]string{"server": "shutting down"})
+		return
+	}
+	s.mu.Lock()
+	checkers := append([]namedChecker{}, s.checkers...)
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.CheckTimeout)
+	defer cancel()
+	type checkResult struct {
+		name string
+		err  error
+	}
+	results := make(chan checkResult, len(checkers))
+	for _, c := range checkers {
+		go func(c namedChecker) {
+			results <- checkResult{c.name, c.fn(ctx)}
+		}(c)
+	}
+
+	status := http.StatusOK
+	result := make(map[string]string, len(checkers))
+wait:
+	for range checkers {
+		select {
+		case res := <-results:
+			result[res.name] = "ok"
+			if res.err != nil {
+				result[res.name] = res.err.Error()
+				status = http.StatusServiceUnavailable
+			}
+		case <-ctx.Done():
+			break wait
+		}
+	}
+	// 超时未完成的检查
+	for _, c := range checkers {
+		if _, ok := result[c.name]; !ok {
+			result[c.name] = "timeout"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeHealth(w, status, result)
+}
+
+func writeHealth(w http.ResponseWriter, status int, data map[string]string) {
+	resp := &BaseResponse{Data: data}
+	if status != http.StatusOK {
+		resp.Code = CodeErrorInternal
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Run 开始监听，收到 SIGINT/SIGTERM 后优雅退出
+func (s *Server) Run() error {
+	errCh := make(chan error, 1)
+	go func() {
+		if s.CertFile != "" && s.KeyFile != "" {
+			errCh <- s.HTTP.ListenAndServeTLS(s.CertFile, s.KeyFile)
+		} else {
+			errCh <- s.HTTP.ListenAndServe()
+		}
+	}()
+	log.Printf("server listen on %s", s.HTTP.Addr)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	select {
+	case err := <-errCh:
+		if err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	case v := <-sig:
+		log.Printf("receive signal %v, shutting down", v)
+	}
+
+	return s.Shutdown(context.Background())
+}
+
+// Shutdown 标记未就绪，等待 ShutdownDelay 后停止接收请求并等待处理中的请求完成，然后按顺序执行退出函数。
+// 等待请求完成的时间为 DrainTimeout，从 ShutdownDelay 结束后开始计算，ctx 用于提前取消
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.stopping, 0, 1) {
+		return nil
+	}
+	if s.ShutdownDelay > 0 {
+		select {
+		case <-time.After(s.ShutdownDelay):
+		case <-ctx.Done():
+		}
+	}
+	// DrainTimeout 从 ShutdownDelay 结束后开始计算
+	if s.DrainTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.DrainTimeout)
+		defer cancel()
+	}
+	err := s.HTTP.Shutdown(ctx)
+	if err != nil {
+		log.Printf("server shutdown error. %v", err)
+	}
+
+	s.mu.Lock()
+	hooks := append([]shutdownHook{}, s.hooks...)
+	s.mu.Unlock()
+	for _, h := range hooks {
+		if herr := h.fn(ctx); herr != nil {
+			log.Printf("shutdown hook %s error. %v", h.name, herr)
+			if err == nil {
+				err = herr
+			}
+		}
+	}
+	return err
+}
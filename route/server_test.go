@@ -0,0 +1,84 @@
+package route
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	s := NewServer(":0", http.NotFoundHandler())
+	var down error
+	s.AddChecker("db", func(ctx context.Context) error { return down })
+	var order []string
+	s.OnShutdown("a", func(ctx context.Context) error { order = append(order, "a"); return nil })
+	s.OnShutdown("b", func(ctx context.Context) error { order = append(order, "b"); return errors.New("b fail") })
+	s.OnShutdown("c", func(ctx context.Context) error { order = append(order, "c"); return nil })
+
+	status := func(path string) int {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+	if status("/healthz") != http.StatusOK || status("/readyz") != http.StatusOK || status("/other") != http.StatusNotFound {
+		t.Fatal("unexpected status before failure")
+	}
+	down = errors.New("ping fail")
+	if status("/readyz") != http.StatusServiceUnavailable {
+		t.Fatal("readyz should fail when checker fails")
+	}
+	down = nil
+
+	// 不响应 context 的检查也不能阻塞就绪检查
+	block := make(chan struct{})
+	defer close(block)
+	s.AddChecker("stuck", func(ctx context.Context) error { <-block; return nil })
+	s.CheckTimeout = 20 * time.Millisecond
+	start := time.Now()
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), `"stuck":"timeout"`) || time.Since(start) > time.Second {
+		t.Fatalf("stuck checker: status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	if err := s.Shutdown(context.Background()); err == nil || err.Error() != "b fail" {
+		t.Fatalf("shutdown err = %v", err)
+	}
+	if !reflect.DeepEqual(order, []string{"a", "b", "c"}) {
+		t.Fatalf("hook order = %v", order)
+	}
+	if status("/readyz") != http.StatusServiceUnavailable || status("/healthz") != http.StatusOK {
+		t.Fatal("readyz should fail after shutdown")
+	}
+}
+
+func TestSinglePing(t *testing.T) {
+	var calls int32
+	block := make(chan struct{})
+	check := singlePing(func() error {
+		atomic.AddInt32(&calls, 1)
+		<-block
+		return errors.New("down")
+	})
+	// mongo 卡住时多次检查只有一个 ping
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		if err := check(ctx); err != context.DeadlineExceeded {
+			t.Fatalf("err = %v", err)
+		}
+		cancel()
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("pings in flight = %d", n)
+	}
+	close(block)
+	if err := check(context.Background()); err == nil || err.Error() != "down" {
+		t.Fatalf("err = %v", err)
+	}
+}
@@ -0,0 +1,189 @@
+package route
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const keyLateHandler = "keyLateHandler"
+
+// timeoutWriter 超时处理函数使用的 Writer。处理函数在单独的 goroutine 中写入缓存，
+// 不会触碰真正的连接，超时后写入的响应只用于 lateHandler
+type timeoutWriter struct {
+	mu      sync.Mutex
+	header  http.Header
+	body    bytes.Buffer
+	status  int
+	written bool
+}
+
+func (w *timeoutWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	w.mu.Lock()
+	if code > 0 && !w.written {
+		w.status = code
+	}
+	w.mu.Unlock()
+}
+
+func (w *timeoutWriter) WriteHeaderNow() {
+	w.mu.Lock()
+	w.written = true
+	w.mu.Unlock()
+}
+
+func (w *timeoutWriter) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.written = true
+	return w.body.Write(data)
+}
+
+func (w *timeoutWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *timeoutWriter) Status() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.status
+}
+
+func (w *timeoutWriter) Size() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.written {
+		return -1
+	}
+	return w.body.Len()
+}
+
+func (w *timeoutWriter) Written() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.written
+}
+
+// Flush 缓存写入，不支持流式响应
+func (w *timeoutWriter) Flush() {}
+
+func (w *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errors.New("hijack is not supported with route timeout")
+}
+
+func (w *timeoutWriter) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
+
+func (w *timeoutWriter) Pusher() http.Pusher {
+	return nil
+}
+
+// lateHandler 超时后仍在运行的处理函数，用于幂等等需要知道处理函数真实结果的中间件
+type lateHandler struct {
+	finished <-chan struct{} // 处理函数返回或 panic 后关闭
+	done     <-chan struct{} // 处理函数正常返回后关闭
+	ctx      *gin.Context
+	writer   *timeoutWriter
+}
+
+// handlerResult 处理函数写入的响应
+type handlerResult struct {
+	Status      int
+	Code        int
+	ContentType string
+	Body        []byte
+}
+
+// wait 等待处理函数结束并返回它写入的响应，处理函数 panic 时返回 nil
+func (h *lateHandler) wait() *handlerResult {
+	<-h.finished
+	select {
+	case <-h.done:
+	default:
+		return nil
+	}
+	w := h.writer
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return &handlerResult{
+		Status:      w.status,
+		Code:        h.ctx.GetInt(keyRespCode),
+		ContentType: w.header.Get("Content-Type"),
+		Body:        append([]byte(nil), w.body.Bytes()...),
+	}
+}
+
+// getLateHandler 请求超时后仍在运行的处理函数
+func (c *Context) getLateHandler() *lateHandler {
+	if v, ok := c.Get(keyLateHandler); ok {
+		return v.(*lateHandler)
+	}
+	return nil
+}
+
+// WithTimeout 限制处理函数的时长，可以通过 BaseRoute.Timeout 配置。
+// 处理函数在单独的 goroutine 中使用 Context 的副本运行，超过 timeout 后立即下发
+// CodeErrorTimeout 并取消请求的 context，之后处理函数的输出被丢弃。
+// 处理函数不能启动流式响应或 Hijack 连接。超时后处理函数仍会运行到结束，
+// IdempotencyMiddleware 会等它结束后再保存或释放幂等键
+func WithTimeout(timeout time.Duration, fn func(*Context)) func(*Context) {
+	return func(c *Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+
+		tw := &timeoutWriter{header: http.Header{}, status: http.StatusOK}
+		cp := c.Context.Copy()
+		cp.Writer = tw
+		done := make(chan struct{})
+		finished := make(chan struct{})
+		panicChan := make(chan interface{}, 1)
+		go func() {
+			defer close(finished)
+			defer func() {
+				if p := recover(); p != nil {
+					panicChan <- newHandlerPanic(p)
+				}
+			}()
+			fn(&Context{Context: cp, router: c.GetRouter()})
+			close(done)
+		}()
+
+		select {
+		case p := <-panicChan:
+			panic(p)
+		case <-done:
+			// 处理函数已经结束，可以安全读取副本
+			for k, v := range cp.Keys {
+				c.Set(k, v)
+			}
+			h := c.Writer.Header()
+			for k, v := range tw.header {
+				h[k] = v
+			}
+			if tw.written || tw.status != http.StatusOK {
+				c.Writer.WriteHeader(tw.status)
+				c.Writer.Write(tw.body.Bytes())
+			}
+		case <-ctx.Done():
+			c.Set(keyLateHandler, &lateHandler{finished: finished, done: done, ctx: cp, writer: tw})
+			c.Logger().Printf("request timeout. %s %s %v %v", c.Request.Method, c.Request.URL, timeout, ctx.Err())
+			c.abortResponse(http.StatusGatewayTimeout, &BaseResponse{
+				Code: CodeErrorTimeout,
+				Msg:  c.ErrorMsg(CodeErrorTimeout, nil),
+			})
+		}
+	}
+}
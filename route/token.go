@@ -0,0 +1,267 @@
+package route
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/skiplee85/common/mongodb"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// TokenTypeRefresh 刷新 token 的类型，不能用于访问接口
+	TokenTypeRefresh = "refresh"
+	familyPrefix     = "fam:"
+)
+
+var (
+	// ErrInvalidRefreshToken 刷新 token 无效或已过期
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused 刷新 token 被重复使用，整个 token 族已被吊销
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+	// ErrNoTokenID token 没有 jti，无法吊销，如升级前签发的 token
+	ErrNoTokenID = errors.New("token has no id")
+)
+
+// TokenPair 访问 token 和刷新 token
+type TokenPair struct {
+	AccessToken      string `json:"accessToken"`
+	ExpiresAt        int64  `json:"expiresAt"`
+	RefreshToken     string `json:"refreshToken"`
+	RefreshExpiresAt int64  `json:"refreshExpiresAt"`
+}
+
+// refreshClaims 刷新 token 信息包，Family 为同一次登录轮换出的所有刷新 token 共享
+type refreshClaims struct {
+	UserClaims
+	Family string `json:"fam"`
+}
+
+// RevocationStore 已吊销 token 的存储，以 jti 为键
+type RevocationStore interface {
+	// Revoke 吊销 jti 直到 expiresAt，jti 已被吊销时返回 false
+	Revoke(jti string, expiresAt time.Time) (bool, error)
+	// IsRevoked jti 是否已被吊销
+	IsRevoked(jti string) (bool, error)
+}
+
+func newTokenID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// SetRevocationStore 设置吊销存储，设置后 authMiddleware 会拒绝已吊销的 token
+func (r *Router) SetRevocationStore(s RevocationStore) {
+	r.Lock()
+	r.revocation = s
+	r.Unlock()
+}
+
+func (r *Router) getRevocationStore() RevocationStore {
+	r.RLock()
+	defer r.RUnlock()
+	return r.revocation
+}
+
+// isRevoked token 是否已被吊销，存储出错时按已吊销处理
+func (r *Router) isRevoked(claims *UserClaims) bool {
+	s := r.getRevocationStore()
+	if s == nil || claims.Id == "" {
+		return false
+	}
+	revoked, err := s.IsRevoked(claims.Id)
+	return err != nil || revoked
+}
+
+// RevokeToken 吊销 token，用于登出。没有 jti 的 token 无法吊销，返回 ErrNoTokenID
+func (r *Router) RevokeToken(claims *UserClaims) error {
+	s := r.getRevocationStore()
+	if s == nil {
+		return errors.New("revocation store not set")
+	}
+	if claims.Id == "" {
+		return ErrNoTokenID
+	}
+	_, err := s.Revoke(claims.Id, time.Unix(claims.ExpiresAt, 0))
+	return err
+}
+
+// IssueTokenPair 签发访问 token 和刷新 token，expire 单位为秒
+func (r *Router) IssueTokenPair(claims *UserClaims, accessExpire, refreshExpire int) (*TokenPair, error) {
+	return r.issueTokenPair(claims, newTokenID(), accessExpire, refreshExpire)
+}
+
+func (r *Router) issueTokenPair(claims *UserClaims, family string, accessExpire, refreshExpire int) (*TokenPair, error) {
+	access := *claims
+	access.Id = ""
+	access.TokenType = ""
+	at, err := r.GenJwtTokenWithClaims(&access, accessExpire)
+	if err != nil {
+		return nil, err
+	}
+
+	refresh := &refreshClaims{
+		UserClaims: *claims,
+		Family:     family,
+	}
+	refresh.Id = newTokenID()
+	refresh.TokenType = TokenTypeRefresh
+	refresh.ExpiresAt = time.Now().Add(time.Duration(refreshExpire) * time.Second).Unix()
+	ks := r.GetKeySet()
+	if ks == nil {
+		return nil, errors.New("no signing key")
+	}
+	rt, err := ks.Sign(refresh)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		AccessToken:      at,
+		ExpiresAt:        access.ExpiresAt,
+		RefreshToken:     rt,
+		RefreshExpiresAt: refresh.ExpiresAt,
+	}, nil
+}
+
+// RefreshToken 使用刷新 token 换取新的 token 对，旧的刷新 token 同时失效。
+// 已使用过的刷新 token 再次使用时视为被盗用，吊销整个 token 族并返回 ErrRefreshTokenReused。
+func (r *Router) RefreshToken(refreshToken string, accessExpire, refreshExpire int) (*TokenPair, error) {
+	ks := r.GetKeySet()
+	s := r.getRevocationStore()
+	if ks == nil || s == nil {
+		return nil, errors.New("key set or revocation store not set")
+	}
+	claims := &refreshClaims{}
+	token, err := jwt.ParseWithClaims(refreshToken, claims, ks.Keyfunc)
+	if err != nil || !token.Valid || claims.TokenType != TokenTypeRefresh || claims.Id == "" || claims.Family == "" {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	familyRevoked, err := s.IsRevoked(familyPrefix + claims.Family)
+	if err != nil {
+		return nil, err
+	}
+	if familyRevoked {
+		return nil, ErrRefreshTokenReused
+	}
+	exp := time.Unix(claims.ExpiresAt, 0)
+	first, err := s.Revoke(claims.Id, exp)
+	if err != nil {
+		return nil, err
+	}
+	if !first {
+		// 刷新 token 族最长存活到本次刷新后签发的刷新 token 过期
+		famExp := time.Now().Add(time.Duration(refreshExpire) * time.Second)
+		if _, err := s.Revoke(familyPrefix+claims.Family, famExp); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+	return r.issueTokenPair(&claims.UserClaims, claims.Family, accessExpire, refreshExpire)
+}
+
+// RevokeToken 吊销当前请求的 token
+func (c *Context) RevokeToken() error {
+	claims := c.GetClaims()
+	if claims == nil {
+		return errors.New("claims not found")
+	}
+	return c.GetRouter().RevokeToken(claims)
+}
+
+// =================== memory ======================
+
+// MemoryRevocationStore 进程内吊销存储，只适合单实例部署
+type MemoryRevocationStore struct {
+	sync.Mutex
+	revoked map[string]time.Time
+}
+
+// NewMemoryRevocationStore 创建进程内吊销存储
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	return &MemoryRevocationStore{revoked: map[string]time.Time{}}
+}
+
+// Revoke 吊销
+func (s *MemoryRevocationStore) Revoke(jti string, expiresAt time.Time) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	if exp, ok := s.revoked[jti]; ok && exp.After(now) {
+		return false, nil
+	}
+	for k, exp := range s.revoked {
+		if !exp.After(now) {
+			delete(s.revoked, k)
+		}
+	}
+	s.revoked[jti] = expiresAt
+	return true, nil
+}
+
+// IsRevoked 是否已吊销
+func (s *MemoryRevocationStore) IsRevoked(jti string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	exp, ok := s.revoked[jti]
+	return ok && exp.After(time.Now()), nil
+}
+
+// =================== mongo ======================
+
+// MongoRevocationStore 基于 mongo 的吊销存储，多实例共享，过期记录由 TTL 索引清理
+type MongoRevocationStore struct {
+	c          *mongodb.DialContext
+	db         string
+	collection string
+}
+
+// NewMongoRevocationStore 创建 mongo 吊销存储
+func NewMongoRevocationStore(c *mongodb.DialContext, db string, collection string) (*MongoRevocationStore, error) {
+	err := c.Do(func(s *mongodb.Session) error {
+		return s.DB(db).C(collection).EnsureIndex(mgo.Index{
+			Key:         []string{"expireAt"},
+			ExpireAfter: time.Second,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &MongoRevocationStore{
+		c:          c,
+		db:         db,
+		collection: collection,
+	}, nil
+}
+
+// Revoke 吊销
+func (s *MongoRevocationStore) Revoke(jti string, expiresAt time.Time) (bool, error) {
+	err := s.c.Insert(s.db, s.collection, bson.M{
+		"_id":      jti,
+		"expireAt": expiresAt,
+	})
+	if mgo.IsDup(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// IsRevoked 是否已吊销
+func (s *MongoRevocationStore) IsRevoked(jti string) (bool, error) {
+	var n int
+	err := s.c.Do(func(ss *mongodb.Session) error {
+		var err error
+		n, err = ss.DB(s.db).C(s.collection).Find(bson.M{
+			"_id":      jti,
+			"expireAt": bson.M{"$gt": time.Now()},
+		}).Count()
+		return err
+	})
+	return n > 0, err
+}
@@ -0,0 +1,90 @@
+package route
+
+import (
+	"net/http"
+	"reflect"
+
+	"github.com/gin-gonic/gin/binding"
+)
+
+// NoArgs 没有参数的接口使用
+type NoArgs struct{}
+
+// Page 带翻页信息的响应
+type Page[T any] struct {
+	List       T
+	Pagination *Pagination
+}
+
+type paginated interface {
+	page() (interface{}, *Pagination)
+}
+
+func (p *Page[T]) page() (interface{}, *Pagination) {
+	return p.List, p.Pagination
+}
+
+// Handle 将 func(*Context, *Req) (*Resp, error) 转为 BaseRoute.Handler。
+// 自动绑定路径参数(uri 标签)和请求参数，校验失败时下发 CodeErrorInvalidArguments，
+// 返回值包装为 BaseResponse，错误通过 SendErr 下发。
+func Handle[Req any, Resp any](fn func(*Context, *Req) (*Resp, error)) func(*Context) {
+	_, noArgs := interface{}(new(Req)).(*NoArgs)
+	return func(c *Context) {
+		req := new(Req)
+		if !noArgs {
+			if len(c.Params) > 0 {
+				params := map[string][]string{}
+				for _, p := range c.Params {
+					params[p.Key] = []string{p.Value}
+				}
+				if err := binding.MapFormWithTag(req, params, "uri"); err != nil {
+					c.Logger().Printf("invalid uri args. %v. url=%s", err, c.Request.URL.String())
+					c.abortResponse(http.StatusOK, &BaseResponse{Code: CodeErrorInvalidArguments, Msg: err.Error()})
+					return
+				}
+			}
+			if c.ValidaArgs(req) != nil {
+				return
+			}
+		}
+
+		resp, err := fn(c, req)
+		if c.Writer.Written() {
+			return
+		}
+		if err != nil {
+			c.SendErr(err)
+			return
+		}
+		if p, ok := interface{}(resp).(paginated); ok && resp != nil {
+			data, pagination := p.page()
+			c.SendWithPagination(data, pagination)
+			return
+		}
+		if resp == nil {
+			c.Send(nil)
+			return
+		}
+		c.Send(resp)
+	}
+}
+
+// TypedRoute 创建使用 Handle 的路由，并根据 Req 和 Resp 生成接口文档
+func TypedRoute[Req any, Resp any](method string, path string, fn func(*Context, *Req) (*Resp, error)) *BaseRoute {
+	doc := &RouteDoc{}
+	if reflect.TypeOf((*Req)(nil)).Elem() != reflect.TypeOf(NoArgs{}) {
+		doc.Args = *new(Req)
+	}
+	var resp interface{} = new(Resp)
+	if p, ok := resp.(paginated); ok {
+		doc.Resp, _ = p.page()
+	} else {
+		doc.Resp = *new(Resp)
+	}
+	return &BaseRoute{
+		Method:  method,
+		Path:    path,
+		Handler: Handle(fn),
+		Doc:     doc,
+	}
+}
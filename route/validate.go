@@ -0,0 +1,153 @@
+package route
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// FieldError 字段校验错误
+type FieldError struct {
+	Field   string `json:"field"` // 字段名，使用 json 标签，嵌套字段用 . 连接
+	Rule    string `json:"rule"`  // 未通过的规则，如 required、phone
+	Param   string `json:"param,omitempty"`
+	Message string `json:"message"`
+}
+
+var (
+	ruleMu   sync.RWMutex
+	ruleMsgs = map[string]string{
+		"required": "{field} is required",
+		"min":      "{field} must be at least {param}",
+		"max":      "{field} must be at most {param}",
+		"len":      "{field} must be {param} in length",
+		"gt":       "{field} must be greater than {param}",
+		"gte":      "{field} must be at least {param}",
+		"lt":       "{field} must be less than {param}",
+		"lte":      "{field} must be at most {param}",
+		"oneof":    "{field} must be one of [{param}]",
+		"email":    "{field} must be a valid email",
+		"phone":    "{field} must be a valid phone number",
+		"idcard":   "{field} must be a valid ID card number",
+	}
+
+	phoneRegexp = regexp.MustCompile(`^1[3-9]\d{9}$`)
+)
+
+func init() {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return
+	}
+	v.RegisterTagNameFunc(validateFieldName)
+	v.RegisterValidation("phone", func(fl validator.FieldLevel) bool {
+		return phoneRegexp.MatchString(fl.Field().String())
+	})
+	v.RegisterValidation("idcard", func(fl validator.FieldLevel) bool {
+		return ValidIDCard(fl.Field().String())
+	})
+}
+
+// validateFieldName 校验错误中的字段名，依次使用 json、form、uri 标签
+func validateFieldName(f reflect.StructField) string {
+	for _, tag := range []string{"json", "form", "uri"} {
+		name := strings.SplitN(f.Tag.Get(tag), ",", 2)[0]
+		if name != "" && name != "-" {
+			return name
+		}
+	}
+	return f.Name
+}
+
+// RegisterValidation 注册自定义校验规则，msg 为默认的错误信息模板，
+// 可以使用 {field} 和 {param}。信息表中的 validate.{tag} 优先于 msg
+func RegisterValidation(tag string, fn validator.Func, msg string) error {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return errors.New("validator engine is not go-playground/validator")
+	}
+	if err := v.RegisterValidation(tag, fn); err != nil {
+		return err
+	}
+	if msg != "" {
+		ruleMu.Lock()
+		ruleMsgs[tag] = msg
+		ruleMu.Unlock()
+	}
+	return nil
+}
+
+// RegisterEnum 注册枚举校验规则，字段的值必须是 values 之一
+func RegisterEnum(tag string, values ...string) error {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return RegisterValidation(tag, func(fl validator.FieldLevel) bool {
+		f := fl.Field()
+		if f.Kind() == reflect.String && f.String() == "" {
+			return true // 空值由 required 检查
+		}
+		return set[fmt.Sprint(f.Interface())]
+	}, "{field} must be one of ["+strings.Join(values, " ")+"]")
+}
+
+// ValidIDCard 校验 18 位居民身份证号码的校验位
+func ValidIDCard(id string) bool {
+	if len(id) != 18 {
+		return false
+	}
+	weights := []int{7, 9, 10, 5, 8, 4, 2, 1, 6, 3, 7, 9, 10, 5, 8, 4, 2}
+	sum := 0
+	for i, w := range weights {
+		if id[i] < '0' || id[i] > '9' {
+			return false
+		}
+		sum += int(id[i]-'0') * w
+	}
+	last := id[17]
+	if last == 'x' {
+		last = 'X'
+	}
+	return "10X98765432"[sum%11] == last
+}
+
+// FieldErrors 将校验错误转为字段错误，信息按当前语言的 validate.{rule} 生成
+func (c *Context) FieldErrors(err error) []FieldError {
+	var ves validator.ValidationErrors
+	if !errors.As(err, &ves) {
+		return nil
+	}
+	fes := make([]FieldError, 0, len(ves))
+	for _, ve := range ves {
+		field := ve.Namespace()
+		if i := strings.Index(field, "."); i >= 0 {
+			field = field[i+1:]
+		}
+		fe := FieldError{
+			Field: field,
+			Rule:  ve.Tag(),
+			Param: ve.Param(),
+		}
+		params := Params{"field": fe.Field, "param": fe.Param}
+		m, ok := c.Message("validate."+fe.Rule, params)
+		if !ok {
+			ruleMu.RLock()
+			m, ok = ruleMsgs[fe.Rule]
+			ruleMu.RUnlock()
+			if !ok {
+				m = "{field} is invalid"
+			}
+			m = formatMessage(m, params)
+		}
+		fe.Message = m
+		fes = append(fes, fe)
+	}
+	return fes
+}
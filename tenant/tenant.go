@@ -0,0 +1,17 @@
+// Package tenant 在 context 中传递租户ID，不依赖数据库驱动，供 route 和 mongodb 共用
+package tenant
+
+import "context"
+
+type key struct{}
+
+// NewContext 将租户ID写入 context
+func NewContext(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, key{}, tenantID)
+}
+
+// FromContext 从 context 读取租户ID
+func FromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(key{}).(string)
+	return id, ok && id != ""
+}
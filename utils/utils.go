@@ -394,19 +394,39 @@ func AesEncryptCFB(origData []byte, key []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	encrypted := make([]byte, aes.BlockSize+len(origData))
-	iv := encrypted[:aes.BlockSize]
+	iv := make([]byte, aes.BlockSize)
 	if _, err := io.ReadFull(crand.Reader, iv); err != nil {
 		return nil, err
 	}
+	return aesEncryptCFB(block, origData, iv), nil
+}
+
+// AesEncryptCFBWithIV 使用指定 IV 加密，相同明文得到相同密文，IV 长度必须为 16
+func AesEncryptCFBWithIV(origData []byte, key []byte, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid iv length %d", len(iv))
+	}
+	return aesEncryptCFB(block, origData, iv), nil
+}
+
+func aesEncryptCFB(block cipher.Block, origData []byte, iv []byte) []byte {
+	encrypted := make([]byte, aes.BlockSize+len(origData))
+	copy(encrypted, iv)
 	stream := cipher.NewCFBEncrypter(block, iv)
 	stream.XORKeyStream(encrypted[aes.BlockSize:], origData)
-	return encrypted, nil
+	return encrypted
 }
 
 // AesDecryptCFB 解密
 func AesDecryptCFB(encrypted []byte, key []byte) (decrypted []byte, err error) {
-	block, _ := aes.NewCipher(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
 	if len(encrypted) < aes.BlockSize {
 		return nil, fmt.Errorf("ciphertext too short")
 	}
@@ -17,3 +17,17 @@ func TestWeightPick(t *testing.T) {
 	ws := []int{20, 20, 60}
 	fmt.Println(WeightPick(ws), WeightPick(ws), WeightPick(ws), WeightPick(ws), WeightPick(ws))
 }
+
+func TestAesCFB(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := []byte("fedcba9876543210")
+	a, _ := AesEncryptCFBWithIV([]byte("hello"), key, iv)
+	b, _ := AesEncryptCFBWithIV([]byte("hello"), key, iv)
+	if string(a) != string(b) {
+		t.Fatal("same iv should produce same ciphertext")
+	}
+	d, err := AesDecryptCFB(a, key)
+	if err != nil || string(d) != "hello" {
+		t.Fatalf("decrypt = %q, %v", d, err)
+	}
+}